@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// burstEvent announces the beginning of a burst of -alternate.
+type burstEvent struct {
+	Burst   int   // counting from zero
+	Runtime int64 // μs
+}
+
+// alternate alternates download and upload bursts of -burst each, using a
+// new connection for each burst, until the total -duration has elapsed. The
+// summary of each burst is the summary of its subtest.
+func alternate(ctx context.Context, useLocate bool) error {
+	if *flagDownload == "" || *flagUpload == "" {
+		return errors.New("-alternate needs the download and upload URLs")
+	}
+	if *flagBurst <= 0 {
+		return errors.New("-burst must be positive")
+	}
+	total := *flagDuration
+	// The subtests run for -duration, so make them run for a burst.
+	*flagDuration = *flagBurst
+	defer func() { *flagDuration = total }()
+	start := testClock.Now()
+	for burst := 0; since(testClock, start) < total; burst++ {
+		if burst > 0 && useLocate {
+			// The locate tokens are for a single connection.
+			if err := locate(ctx); err != nil {
+				return err
+			}
+		}
+		testname, URL, maxSize := "download", flagDownload, *flagMaxMessageSize
+		if burst%2 != 0 {
+			testname, URL, maxSize = "upload", flagUpload, uploadMaxMessageSize()
+		}
+		emit("Burst", burstEvent{
+			Burst:   burst,
+			Runtime: int64(*flagBurst / time.Microsecond),
+		}, testname)
+		emitBegin(*URL, *flagBurst, measureInterval, maxSize, testname)
+		conn, err := connect(ctx, URL, useLocate, testname)
+		if err != nil {
+			return err
+		}
+		if testname == "download" {
+			_, err = downloadTest(ctx, testClock, conn)
+		} else {
+			_, err = uploadTest(ctx, testClock, conn)
+		}
+		closeConn(conn)
+		if err != nil {
+			warnx(err, testname)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// clock abstracts the passing of time for the subtests, such that the
+// timing logic does not need to depend on the wall clock.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	Sleep(d time.Duration)
+}
+
+// ticker abstracts a time.Ticker.
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock based on the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// wallClock is like realClock except that the times do not contain the
+// monotonic clock reading, hence the elapsed times reflect the adjustments
+// of the wall clock, e.g. by NTP, which may even make them negative.
+type wallClock struct {
+	realClock
+}
+
+func (wallClock) Now() time.Time {
+	return time.Now().Round(0) // strips the monotonic clock reading
+}
+
+// testClock is the clock selected by -clock, which we pass to the subtests.
+var testClock clock = realClock{}
+
+// setClock selects the clock passed to the subtests given the -clock name.
+func setClock(name string) error {
+	switch name {
+	case "mono":
+		testClock = realClock{}
+	case "wall":
+		testClock = wallClock{}
+	default:
+		return errors.New("-clock must be wall or mono")
+	}
+	return nil
+}
+
+// since is like time.Since but uses clk.
+func since(clk clock, t time.Time) time.Duration {
+	return clk.Now().Sub(t)
+}
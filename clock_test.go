@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when we advance it, such that
+// the tests of the timing logic do not depend on the wall clock.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clk: c, ch: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Sleep advances the clock, since nobody else would.
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Advance moves the clock forward by d, firing the tickers that expire. Like
+// the tickers of the time package, they drop the ticks nobody received.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for ; !t.stopped && !t.next.After(c.now); t.next = t.next.Add(t.period) {
+			select {
+			case t.ch <- t.next:
+			default:
+			}
+		}
+	}
+}
+
+type fakeTicker struct {
+	clk     *fakeClock
+	ch      chan time.Time
+	period  time.Duration
+	next    time.Time // protected by clk.mu
+	stopped bool      // likewise
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	t.stopped = true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// coldWarmResult compares a download over a fresh path with a download
+// started immediately after it, which reveals warmup effects such as the
+// caching of TCP metrics or slow start state at the server or on the path.
+type coldWarmResult struct {
+	Cold       *downloadSummary `json:",omitempty"`
+	Warm       *downloadSummary `json:",omitempty"`
+	WarmToCold float64          `json:",omitempty"` // ratio of the throughputs
+}
+
+// coldWarm runs two back-to-back downloads against the same server, each
+// over its own connection, and emits a ColdWarm event with both summaries.
+func coldWarm(ctx context.Context, useLocate bool) error {
+	if *flagDownload == "" {
+		return errors.New("-cold-warm needs the download URL")
+	}
+	// Locate may otherwise return another server for the second download.
+	sameServer := *flagSameServer
+	*flagSameServer = true
+	defer func() { *flagSameServer = sameServer }()
+	var result coldWarmResult
+	for run := 0; run < 2; run++ {
+		if run > 0 && useLocate {
+			// The locate tokens are for a single connection.
+			if err := locate(ctx); err != nil {
+				return err
+			}
+		}
+		emitBegin(*flagDownload, *flagDuration, measureInterval, *flagMaxMessageSize, "download")
+		conn, err := connect(ctx, flagDownload, useLocate, "download")
+		if err != nil {
+			return err
+		}
+		summary, err := downloadTest(ctx, testClock, conn)
+		closeConn(conn)
+		if err != nil {
+			warnx(err, "download")
+		}
+		if run == 0 {
+			result.Cold = &summary
+		} else {
+			result.Warm = &summary
+		}
+	}
+	if result.Cold.Throughput > 0 {
+		result.WarmToCold = result.Warm.Throughput / result.Cold.Throughput
+	}
+	emit("ColdWarm", result, "download")
+	return nil
+}
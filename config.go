@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// sensitiveFlags are the flags whose whole value is a secret.
+var sensitiveFlags = map[string]bool{
+	"webhook":      true, // may contain a token anywhere, e.g. in the path
+	"webhook-auth": true,
+}
+
+// printConfig prints the value of every flag, after applying the defaults
+// and the environment variables, as a JSON object, with the credentials in
+// URLs and the sensitive flags redacted.
+func printConfig() error {
+	config := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		var value interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		switch v := value.(type) {
+		case string:
+			value = redactURL(v)
+			if sensitiveFlags[f.Name] && v != "" {
+				value = "REDACTED"
+			}
+		case time.Duration:
+			value = v.String() // more readable than nanoseconds
+		}
+		config[f.Name] = value
+	})
+	data, err := marshalJSON(config)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+	return err
+}
@@ -0,0 +1,16 @@
+package main
+
+import "syscall"
+
+// setCongestion arranges, with -congestion, for the connections to use the
+// given TCP congestion control algorithm, e.g. bbr or cubic. The kernel must
+// support the algorithm, otherwise connecting fails.
+func setCongestion(algorithm string) error {
+	if algorithm == "" {
+		return nil
+	}
+	socketOptions = append(socketOptions, func(fd uintptr) error {
+		return syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, algorithm)
+	})
+	return nil
+}
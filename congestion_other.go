@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// setCongestion fails with -congestion, since we only support Linux.
+func setCongestion(algorithm string) error {
+	if algorithm != "" {
+		return errors.New("-congestion is only supported on Linux")
+	}
+	return nil
+}
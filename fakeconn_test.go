@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeConn is a net.Conn whose deadlines use a fakeClock, which advances by
+// readStep after each read and by writeStep after each write, such that the
+// subtests see the time passing as they transfer data. Since it wraps one
+// end of a net.Pipe, each read returns at most the data of a single write,
+// hence a message of the server, which makes the tests deterministic.
+type fakeConn struct {
+	net.Conn
+	clk           *fakeClock
+	readStep      time.Duration
+	writeStep     time.Duration
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// errFakeTimeout is the error of a fakeConn whose deadline expired.
+var errFakeTimeout net.Error = fakeTimeoutError{}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func (c *fakeConn) Read(data []byte) (int, error) {
+	if c.expired(&c.readDeadline) {
+		return 0, errFakeTimeout
+	}
+	n, err := c.Conn.Read(data)
+	c.clk.Advance(c.readStep)
+	return n, err
+}
+
+func (c *fakeConn) Write(data []byte) (int, error) {
+	if c.expired(&c.writeDeadline) {
+		return 0, errFakeTimeout
+	}
+	n, err := c.Conn.Write(data)
+	c.clk.Advance(c.writeStep)
+	return n, err
+}
+
+func (c *fakeConn) expired(deadline *time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !deadline.IsZero() && !c.clk.Now().Before(*deadline)
+}
+
+func (c *fakeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline records the deadline and, when it already expired,
+// interrupts any pending read, which is how the subtests stop reading.
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(c.pipeDeadline(t))
+}
+
+func (c *fakeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(c.pipeDeadline(t))
+}
+
+// pipeDeadline maps the fake deadline t to a deadline for the pipe, which
+// uses the wall clock: either now, if t expired, or none at all.
+func (c *fakeConn) pipeDeadline(t time.Time) time.Time {
+	if !t.IsZero() && !c.clk.Now().Before(t) {
+		return time.Now()
+	}
+	return time.Time{}
+}
+
+// pipeListener is a net.Listener returning the server end of a net.Pipe.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// dialFake returns a client connection over a fakeConn using clk, whose
+// server runs handler. The caller should call close when done.
+func dialFake(t *testing.T, clk *fakeClock, handler func(conn *websocket.Conn)) (
+	*websocket.Conn, *fakeConn, func()) {
+	listener := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := fakeUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handler(conn)
+	})}
+	go server.Serve(listener)
+	var fake *fakeConn
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			select {
+			case listener.conns <- server:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			fake = &fakeConn{Conn: client, clk: clk}
+			return fake, nil
+		},
+		Subprotocols: []string{subprotocol},
+	}
+	conn, _, err := dialer.Dial("ws://127.0.0.1/ndt/v7/test", nil)
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	return conn, fake, func() {
+		conn.Close()
+		listener.Close()
+	}
+}
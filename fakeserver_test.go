@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer is a minimal ndt7 server for the tests.
+type fakeServer struct {
+	*httptest.Server
+	runtime time.Duration // how long the download and upload run
+}
+
+// newFakeServer starts a fakeServer whose download and upload run for
+// the given time, unless the client closes first. The caller should
+// close it when done.
+func newFakeServer(runtime time.Duration) *fakeServer {
+	srv := &fakeServer{runtime: runtime}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ndt/v7/download", srv.download)
+	mux.HandleFunc("/ndt/v7/upload", srv.upload)
+	mux.HandleFunc("/ndt/v7/roundtrip", srv.roundTrip)
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+// URL returns the ws:// URL of the given subtest.
+func (srv *fakeServer) URL(testname string) string {
+	return strings.Replace(srv.Server.URL, "http://", "ws://", 1) + "/ndt/v7/" + testname
+}
+
+var fakeUpgrader = websocket.Upgrader{Subprotocols: []string{subprotocol}}
+
+// closeFakeConn sends the close frame of the server, which ends the test.
+func closeFakeConn(conn *websocket.Conn) {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
+
+func (srv *fakeServer) download(w http.ResponseWriter, r *http.Request) {
+	conn, err := fakeUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// Read such that we process the close frame of the client, which
+	// makes the next write fail, as the real servers do.
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	data := make([]byte, 1<<13)
+	for start := time.Now(); time.Since(start) < srv.runtime; {
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			return
+		}
+	}
+	closeFakeConn(conn)
+}
+
+func (srv *fakeServer) upload(w http.ResponseWriter, r *http.Request) {
+	conn, err := fakeUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(srv.runtime))
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+	closeFakeConn(conn)
+}
+
+func (srv *fakeServer) roundTrip(w http.ResponseWriter, r *http.Request) {
+	conn, err := fakeUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for start := time.Now(); time.Since(start) < srv.runtime; {
+		data, err := json.Marshal(roundTripRequest{
+			RTTVar: 100,
+			SRTT:   1000,
+			ST:     time.Since(start) / time.Microsecond,
+		})
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+	closeFakeConn(conn)
+}
+
+// captureEvents makes emit write into the returned buffer, rather than
+// into the standard output, until the caller calls restore.
+func captureEvents() (output *bytes.Buffer, restore func()) {
+	output = &bytes.Buffer{}
+	samples, summary, events := samplesWriter, summaryWriter, eventsWriter
+	samplesWriter, summaryWriter, eventsWriter = output, output, output
+	return output, func() {
+		samplesWriter, summaryWriter, eventsWriter = samples, summary, events
+	}
+}
+
+// saveFlags returns a function restoring the flags that the tests change.
+func saveFlags() (restore func()) {
+	download, upload, roundTrip := *flagDownload, *flagUpload, *flagRoundTrip
+	duration, roundTripCount := *flagDuration, *flagRoundTripCount
+	return func() {
+		*flagDownload, *flagUpload, *flagRoundTrip = download, upload, roundTrip
+		*flagDuration, *flagRoundTripCount = duration, roundTripCount
+	}
+}
@@ -1,5 +1,8 @@
 module github.com/bassosimone/ndt7-client-go-minimal
 
-require github.com/gorilla/websocket v1.4.2
+require (
+	github.com/gorilla/websocket v1.4.2
+	google.golang.org/protobuf v1.31.0
+)
 
 go 1.13
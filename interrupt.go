@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// exitInterrupted is the exit code used when the user interrupts us, which
+// is what shells use for processes killed by SIGINT.
+const exitInterrupted = 130
+
+// interrupted is nonzero after the user interrupted us.
+var interrupted int32
+
+// withInterrupt returns a context cancelled on SIGINT, such that the user
+// may stop us cleanly. We stop handling SIGINT after the first one, hence
+// a second SIGINT kills us in case stopping hangs.
+func withInterrupt(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		atomic.StoreInt32(&interrupted, 1)
+		cancel()
+	}()
+	return ctx
+}
+
+// checkInterrupted exits with exitInterrupted if the user interrupted us.
+// We call it before reporting errors, which the interruption likely caused,
+// and after each step of the suite, such that we neither run the next
+// steps nor report the truncated results as if the suite completed.
+func checkInterrupted() {
+	if atomic.LoadInt32(&interrupted) != 0 {
+		exit(exitInterrupted)
+	}
+}
+
+// sleep sleeps for d, unless ctx is done meanwhile, in which case it
+// returns early. Call checkInterrupted afterwards to stop on SIGINT.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
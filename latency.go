@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// latencyUnderLoadResult compares the RTT of an idle link with the RTT of
+// the same link while a download saturates it, which reveals bufferbloat.
+type latencyUnderLoadResult struct {
+	Idle           rttStats
+	Loaded         rttStats
+	MedianIncrease float64 // loaded minus idle median (μs)
+}
+
+// latencyUnderLoad runs a round-trip test to measure the idle baseline and
+// then another round-trip test concurrently with a download. Each test uses
+// its own connection, as required by the ndt7 specification. Since locate
+// does not return the round-trip URL, this mode requires explicit URLs.
+func latencyUnderLoad(ctx context.Context) error {
+	if *flagRoundTrip == "" || *flagDownload == "" {
+		return errors.New("-latency-under-load needs the round trip and download URLs")
+	}
+	emitBegin(*flagRoundTrip, roundTripRuntime, 0, roundTripMaxMessageSize, "roundtrip")
+	conn, err := connect(ctx, flagRoundTrip, false, "roundtrip")
+	if err != nil {
+		return err
+	}
+	idle, err := roundTripTest(ctx, testClock, conn)
+	closeConn(conn)
+	if err != nil {
+		warnx(err, "roundtrip")
+	}
+	emitBegin(*flagDownload, *flagDuration, measureInterval, *flagMaxMessageSize, "download")
+	downloadConn, err := connect(ctx, flagDownload, false, "download")
+	if err != nil {
+		return err
+	}
+	emitBegin(*flagRoundTrip, roundTripRuntime, 0, roundTripMaxMessageSize, "roundtrip")
+	roundTripConn, err := connect(ctx, flagRoundTrip, false, "roundtrip")
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := downloadTest(ctx, testClock, downloadConn); err != nil {
+			warnx(err, "download")
+		}
+		closeConn(downloadConn)
+	}()
+	loaded, err := roundTripTest(ctx, testClock, roundTripConn)
+	closeConn(roundTripConn)
+	if err != nil {
+		warnx(err, "roundtrip")
+	}
+	wg.Wait()
+	emit("LatencyUnderLoad", latencyUnderLoadResult{
+		Idle:           idle.SRTTStats,
+		Loaded:         loaded.SRTTStats,
+		MedianIncrease: loaded.SRTTStats.Median - idle.SRTTStats.Median,
+	}, "roundtrip")
+	return nil
+}
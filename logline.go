@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// loglineFormatter emits, for each run of the suite, a single line like
+//
+//	ndt7 ok download=94.2Mbit upload=11.3Mbit rtt=23ms server=mlab1.xyz
+//
+// which is suitable for logs. The line begins with fail when any subtest
+// failed, such that alerts can just grep for it. The server is a host name,
+// hence the line never contains the tokens in the URLs.
+type loglineFormatter struct {
+	failed bool
+	minRTT int64 // minimum of the server measured min RTT (μs)
+	wrote  bool  // whether we wrote the line of a run
+}
+
+func (f *loglineFormatter) Format(name string, value interface{}, testname string) ([]byte, error) {
+	switch v := value.(type) {
+	case serverMeasurement:
+		f.minRTT = serverMinRTT(v, f.minRTT)
+	case failureEvent:
+		f.failed = true
+	case *report:
+		line := f.line(v)
+		f.failed, f.minRTT = false, 0 // ready for the next -repeat iteration
+		f.wrote = true
+		return line, nil
+	}
+	if name == "Abort" {
+		f.failed = true
+	}
+	return nil, nil
+}
+
+// Final returns the fail line when we exit with a non-zero exitcode, e.g.
+// because of -fail-fast or -max-rtt, before writing the line of the run,
+// where rep is the report of the running suite, if any. We do not write
+// another line when the line of the last run already tells the failure.
+func (f *loglineFormatter) Final(exitcode int, rep *report) []byte {
+	if exitcode == 0 || (rep == nil && f.wrote && !f.failed) {
+		return nil
+	}
+	partial := report{}
+	if rep != nil {
+		partial = *rep
+	} else if lastReport != nil && !f.wrote {
+		partial = *lastReport // with -quiet-on-success, we did not write it
+	}
+	partial.Server = reportServer()
+	f.failed = true
+	return f.line(&partial)
+}
+
+func (f *loglineFormatter) line(rep *report) []byte {
+	fields := []string{"ndt7", "ok"}
+	if f.failed {
+		fields[1] = "fail"
+	}
+	if rep.Download != nil {
+		fields = append(fields, fmt.Sprintf("download=%.1fMbit", rep.Download.Throughput/1e06))
+	}
+	if rep.Upload != nil {
+		fields = append(fields, fmt.Sprintf("upload=%.1fMbit", rep.Upload.Throughput/1e06))
+	}
+	if rep.RoundTrip != nil && rep.RoundTrip.MinSRTT > 0 {
+		fields = append(fields, fmt.Sprintf("rtt=%.0fms", rep.RoundTrip.MinSRTT/1e03))
+	} else if f.minRTT > 0 {
+		fields = append(fields, fmt.Sprintf("rtt=%.0fms", float64(f.minRTT)/1e03))
+	}
+	if rep.Server != "" {
+		fields = append(fields, "server="+rep.Server)
+	}
+	return []byte(strings.Join(fields, " ") + "\n")
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestLoglineFinal(t *testing.T) {
+	defer saveFlags()()
+	*flagDownload, *flagUpload, *flagRoundTrip = "ws://ndt.example.com/ndt/v7/download", "", ""
+	download := &downloadSummary{testResult: testResult{Throughput: 94.2e06}}
+	tests := []struct {
+		name     string
+		events   []string // emitted before exiting
+		rep      *report  // the report of the running suite
+		exitcode int
+		expect   string
+	}{
+		{"success", []string{"Report"}, nil, 0, ""},
+		{"failure after the line", []string{"Failure", "Report"}, nil, 1, ""},
+		{"failure before the line", []string{"Failure"}, &report{Download: download}, 3,
+			"ndt7 fail download=94.2Mbit server=ndt.example.com\n"},
+		{"abort", []string{"Abort"}, &report{}, 5, "ndt7 fail server=ndt.example.com\n"},
+		{"failure without a report", []string{"Failure"}, nil, 1, "ndt7 fail server=ndt.example.com\n"},
+		{"failure after a previous line", []string{"Report", "Failure"}, nil, 1,
+			"ndt7 fail server=ndt.example.com\n"},
+		{"interrupted run", []string{"Report"}, &report{}, exitInterrupted,
+			"ndt7 fail server=ndt.example.com\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &loglineFormatter{}
+			for _, name := range tt.events {
+				var value interface{} = name
+				switch name {
+				case "Failure":
+					value = failureEvent{Error: "mocked error"}
+				case "Report":
+					value = &report{}
+				}
+				if _, err := f.Format(name, value, "suite"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := string(f.Final(tt.exitcode, tt.rep)); got != tt.expect {
+				t.Fatalf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
@@ -2,15 +2,29 @@ package main
 
 import (
 	"context"
+	cryptorand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -26,6 +40,9 @@ const (
 
 	roundTripMaxMessageSize = 1 << 17
 	roundTripRuntime        = 3 * time.Second
+
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
 )
 
 type roundTripRequest struct {
@@ -34,10 +51,12 @@ type roundTripRequest struct {
 	ST     time.Duration // sender time (μs)
 }
 
-func (rrr roundTripRequest) String(elapsed time.Duration) string {
-	return fmt.Sprintf(
-		`{"AppInfo":{"SRTT":%f,"RTTVar":%f,"ElapsedTime":%d},"Test":"%s"}`,
-		rrr.SRTT, rrr.RTTVar, elapsed, "roundtrip")
+// roundTripAppInfo is the event emitted for each round-trip sample.
+type roundTripAppInfo struct {
+	SRTT        float64
+	RTTVar      float64
+	ElapsedTime int64
+	Warmup      bool `json:",omitempty"` // excluded from the statistics
 }
 
 type roundTripReply struct {
@@ -49,14 +68,15 @@ type roundTripReply struct {
 type roundTripRecvInfo struct {
 	msg      roundTripRequest
 	recvTime time.Time
+	size     int64
 }
 
-func roundTripRecv(conn *websocket.Conn) (*roundTripRecvInfo, error) {
+func roundTripRecv(clk clock, conn *websocket.Conn) (*roundTripRecvInfo, error) {
 	kind, reader, err := conn.NextReader()
 	if err != nil {
 		return nil, err
 	}
-	recvTime := time.Now()
+	recvTime := clk.Now()
 	if kind != websocket.TextMessage {
 		return nil, errors.New("unexpected message type")
 	}
@@ -69,222 +89,2080 @@ func roundTripRecv(conn *websocket.Conn) (*roundTripRecvInfo, error) {
 		return nil, err
 	}
 	info.recvTime = recvTime
+	info.size = int64(len(data))
 	return &info, nil
 }
 
-func roundTripTest(ctx context.Context, conn *websocket.Conn) error {
-	start := time.Now()
+func roundTripTest(ctx context.Context, clk clock, conn *websocket.Conn) (summary roundTripSummary, err error) {
+	if err := checkSubprotocol(conn); err != nil {
+		return summary, err
+	}
+	start := clk.Now()
+	defer wrapSubtestError(clk, &err, start)
 	if err := conn.SetReadDeadline(start.Add(roundTripRuntime)); err != nil {
-		return err
+		return summary, err
 	}
 	if err := conn.SetWriteDeadline(start.Add(roundTripRuntime)); err != nil {
-		return err
+		return summary, err
 	}
 	conn.SetReadLimit(roundTripMaxMessageSize)
-	for ctx.Err() == nil {
-		info, err := roundTripRecv(conn)
+	ticker := clk.NewTicker(measureInterval)
+	defer ticker.Stop()
+	var received, sent int64
+	var minSRTT float64
+	var samples []float64
+	var code int
+	var (
+		gaps     []float64 // with -frame-timing
+		prevRecv time.Time
+	)
+	defer func() {
+		summary = roundTripSummary{
+			testResult:    newTestResult(since(clk, start), received+sent),
+			BytesReceived: received,
+			BytesSent:     sent,
+			MinSRTT:       minSRTT,
+			SRTTStats:     newRTTStats(samples),
+		}
+		summary.CloseCode = code
+		if *flagFrameTiming {
+			gapStats := newRTTStats(gaps)
+			summary.FrameGapStats = &gapStats
+		}
+		emitSummary(summary, "roundtrip")
+	}()
+	for count := 0; ctx.Err() == nil; count++ {
+		if *flagRoundTripCount > 0 && count >= *flagRoundTripCount {
+			return summary, nil
+		}
+		info, err := roundTripRecv(clk, conn)
+		code = closeCode(err)
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return summary, nil // the server is done with the test
+		}
 		if err != nil {
-			return err
+			return summary, err
+		}
+		received += info.size
+		if !prevRecv.IsZero() {
+			gaps = append(gaps, float64(info.recvTime.Sub(prevRecv)/time.Microsecond))
+		}
+		prevRecv = info.recvTime
+		warmup := count < *flagRoundTripWarmup
+		if !warmup {
+			if minSRTT == 0 || info.msg.SRTT < minSRTT {
+				minSRTT = info.msg.SRTT
+			}
+			samples = append(samples, info.msg.SRTT)
+		}
+		emit("AppInfo", roundTripAppInfo{
+			SRTT:        info.msg.SRTT,
+			RTTVar:      info.msg.RTTVar,
+			ElapsedTime: int64(info.recvTime.Sub(start)),
+			Warmup:      warmup,
+		}, "roundtrip")
+		select {
+		case <-ticker.Chan():
+			if *flagRoundTripStats {
+				emit("RTTStats", newRTTStats(samples), "roundtrip")
+			}
+		default:
+			// NOTHING
 		}
-		fmt.Printf("%s\n\n", info.msg.String(info.recvTime.Sub(start)))
 		reply := roundTripReply{
 			STE: info.msg.ST,
 			STD: info.recvTime.Sub(start)/time.Microsecond - info.msg.ST,
-			RT:  time.Since(start) / time.Microsecond,
+			RT:  since(clk, start) / time.Microsecond,
 		}
-		if err := conn.WriteJSON(reply); err != nil {
-			return err
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return summary, err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return summary, err
 		}
+		sent += int64(len(data))
 	}
-	return nil
+	return summary, nil
+}
+
+// subtestError is an error occurred during a subtest.
+type subtestError struct {
+	err     error
+	elapsed time.Duration // since the beginning of the subtest
+	time    time.Time
+}
+
+func (e *subtestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *subtestError) Unwrap() error {
+	return e.err
+}
+
+// wrapSubtestError wraps *err, if not nil, into a subtestError such that
+// the failure event can say when the error occurred.
+func wrapSubtestError(clk clock, err *error, start time.Time) {
+	if *err != nil {
+		now := clk.Now()
+		*err = &subtestError{err: *err, elapsed: now.Sub(start), time: now}
+	}
+}
+
+// frameSizeBucket counts the binary frames whose size is at most Max bytes
+// and larger than the Max of the previous bucket.
+type frameSizeBucket struct {
+	Max   int64
+	Count int64
+}
+
+// newFrameSizeHistogram returns power-of-two buckets spanning the range
+// of message sizes a well-behaved server may send us.
+func newFrameSizeHistogram() []frameSizeBucket {
+	var buckets []frameSizeBucket
+	for size := int64(minMessageSize); size <= maxMessageSize; size <<= 1 {
+		buckets = append(buckets, frameSizeBucket{Max: size})
+	}
+	return buckets
+}
+
+func frameSizeHistogramAdd(buckets []frameSizeBucket, size int64) {
+	for idx := range buckets {
+		if size <= buckets[idx].Max {
+			buckets[idx].Count++
+			return
+		}
+	}
+	// Only reached when -max-message-size exceeds maxMessageSize.
+	buckets[len(buckets)-1].Count++
+}
+
+// bbrInfo contains the BBR variables measured by the server.
+type bbrInfo struct {
+	BW     int64 // bandwidth estimate (bit/s)
+	MinRTT int64 // minimum RTT (μs)
+}
+
+// tcpInfo contains the TCP_INFO variables measured by the server. The time
+// limited by the receive window or by the send buffer, compared with the
+// busy time, tells whether the throughput was limited by the window rather
+// than by congestion.
+type tcpInfo struct {
+	MinRTT        int64 // minimum RTT (μs)
+	ElapsedTime   int64 `json:",omitempty"` // since the server started measuring (μs)
+	BytesReceived int64 `json:",omitempty"` // received by the server
+	BusyTime      int64 `json:",omitempty"` // time spent sending (μs)
+	RWndLimited   int64 `json:",omitempty"` // time limited by the receive window (μs)
+	SndBufLimited int64 `json:",omitempty"` // time limited by the send buffer (μs)
+	DeliveryRate  int64 `json:",omitempty"` // bytes/s
+}
+
+// measurement is the parsed subset of a server measurement.
+type measurement struct {
+	BBRInfo *bbrInfo
+	TCPInfo *tcpInfo
+}
+
+// testResult contains the fields shared by the summaries of all subtests.
+type testResult struct {
+	ElapsedTime int64   // μs
+	NumBytes    int64   // bytes sent and received
+	Throughput  float64 // bit/s
+	CloseCode   int     `json:",omitempty"` // sent by the server, if any
+	// LowConfidence is set, with -min-samples, when the download or the
+	// upload produced too few samples to trust the throughput.
+	LowConfidence bool `json:",omitempty"`
+}
+
+func (r testResult) result() testResult {
+	return r
+}
+
+func newTestResult(elapsed time.Duration, total int64) testResult {
+	result := testResult{
+		ElapsedTime: int64(elapsed / time.Microsecond),
+		NumBytes:    total,
+	}
+	if elapsed > 0 {
+		result.Throughput = float64(total*8) / elapsed.Seconds()
+	}
+	return result
+}
+
+type downloadSummary struct {
+	testResult
+	FrameSizes    []frameSizeBucket
+	Saturated     bool
+	ServerBBRInfo *bbrInfo  `json:",omitempty"`
+	ServerTCPInfo *tcpInfo  `json:",omitempty"` // the last measured by the server
+	Samples       []appInfo `json:",omitempty"` // with -embed-samples
+	// ServerFrames contains the server measurements, with -keep-server-frames.
+	ServerFrames []json.RawMessage `json:",omitempty"`
+	// TTFBMicros is the time from the end of the handshake to the first
+	// binary message, which is how long the server takes to start sending.
+	TTFBMicros int64 `json:",omitempty"`
+	// ByteLimitTime is when we transferred -max-bytes (μs), which differs
+	// from ElapsedTime when -min-duration makes the subtest run longer.
+	ByteLimitTime int64 `json:",omitempty"`
+	// AnalyzeFromBytes and AnalyzeFromTime (μs) are when we reached the
+	// -analyze-from-bytes offset, which testResult excludes. Since we count
+	// whole messages, AnalyzeFromBytes may be larger than the offset.
+	AnalyzeFromBytes int64 `json:",omitempty"`
+	AnalyzeFromTime  int64 `json:",omitempty"`
+	// reusable is whether neither side closed the connection, which only
+	// happens when we stop at -max-bytes without -drain. Otherwise, the
+	// connection is not usable for -reuse-conn.
+	reusable bool
+}
+
+// maxServerFrames is the maximum number of server measurements we keep with
+// -keep-server-frames, which is way more than a regular download produces.
+const maxServerFrames = 10000
+
+// exitLowConfidence is the exit code used, with -low-confidence-fails, when
+// the download or the upload produced less than -min-samples samples.
+const exitLowConfidence = 10
+
+// anyLowConfidence is whether any subtest produced too few samples. Since
+// servers may be tested concurrently, it is accessed atomically.
+var anyLowConfidence int32
+
+// lowConfidence returns whether numSamples is below -min-samples and emits
+// a warning in such a case.
+func lowConfidence(numSamples int, testname string) bool {
+	if numSamples >= *flagMinSamples {
+		return false
+	}
+	emit("Warning", fmt.Sprintf("%s produced only %d samples, less than -min-samples %d",
+		testname, numSamples, *flagMinSamples), testname)
+	atomic.StoreInt32(&anyLowConfidence, 1)
+	return true
+}
+
+// saturationTolerance is how much faster than the plateau the last interval
+// may be while still considering the throughput as no longer rising.
+const saturationTolerance = 1.1
+
+// saturated returns whether the throughput measured during the intervals
+// (in any unit) had settled by the end of the test. We compare the last
+// interval to the best of the previous intervals in the second half of the
+// test: if it is still noticeably faster, the link was likely not saturated.
+func saturated(intervals []float64) bool {
+	if len(intervals) < 4 {
+		return false // too short to tell
+	}
+	last := intervals[len(intervals)-1]
+	var plateau float64
+	for _, value := range intervals[len(intervals)/2 : len(intervals)-1] {
+		plateau = math.Max(plateau, value)
+	}
+	return last <= plateau*saturationTolerance
+}
+
+// uploadSummary describes an upload. When the server measures the bytes
+// it received, testResult is computed using them, since they exclude the
+// data in flight, like the official ndt7 clients do.
+type uploadSummary struct {
+	testResult
+	ClientNumBytes   int64     // bytes we sent
+	ClientThroughput float64   // bit/s, computed using ClientNumBytes
+	Samples          []appInfo `json:",omitempty"` // with -embed-samples
+	ByteLimitTime    int64     `json:",omitempty"` // see downloadSummary
+}
+
+type roundTripSummary struct {
+	testResult
+	BytesReceived int64
+	BytesSent     int64
+	MinSRTT       float64 // minimum smoothed RTT (μs)
+	SRTTStats     rttStats
+	// FrameGapStats describes the time between successive server messages
+	// (μs), i.e., the server's send cadence, with -frame-timing.
+	FrameGapStats *rttStats `json:",omitempty"`
+}
+
+// rttStats describes the distribution of RTT samples (μs). We also use it
+// for other distributions of times.
+type rttStats struct {
+	Count  int
+	Min    float64
+	Mean   float64
+	Median float64
+	P90    float64
+	Max    float64
+}
+
+// newRTTStats computes the statistics of the given samples.
+func newRTTStats(samples []float64) rttStats {
+	if len(samples) < 1 {
+		return rttStats{}
+	}
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	percentile := func(p float64) float64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1] // nearest rank
+	}
+	var sum float64
+	for _, sample := range sorted {
+		sum += sample
+	}
+	return rttStats{
+		Count:  len(sorted),
+		Min:    sorted[0],
+		Mean:   sum / float64(len(sorted)),
+		Median: percentile(0.5),
+		P90:    percentile(0.9),
+		Max:    sorted[len(sorted)-1],
+	}
+}
+
+// beginEvent records the parameters a subtest is about to use.
+type beginEvent struct {
+	ClientVersion  string
+	Interval       int64 // measurement interval (μs)
+	MaxMessageSize int64
+	NoVerify       bool
+	PayloadSeed    *int64 `json:",omitempty"` // only for random upload payloads
+	Runtime        int64  // maximum runtime (μs)
+	Scheme         string // ws or wss
+	Subprotocol    string
+	URL            string
+	ReadDelay      int64   `json:",omitempty"` // with -read-delay (μs)
+	UploadRamp     int64   `json:",omitempty"` // with -upload-ramp (μs)
+	UploadRampRate float64 `json:",omitempty"` // with -upload-ramp (bit/s)
+}
+
+// subtestsRun counts the subtests we started to run. Since servers may be
+// tested concurrently, it is accessed atomically.
+var subtestsRun int64
+
+// exitNoSubtests is the exit code used when we did not run any subtest.
+const exitNoSubtests = 9
+
+// checkSubtestsRun exits if we did not run any subtest, which is likely a
+// mistake in the command line, e.g. an empty -servers-file, that we do not
+// want to go unnoticed in automation that assumes a subtest ran.
+func checkSubtestsRun() {
+	if atomic.LoadInt64(&subtestsRun) < 1 {
+		errx(exitNoSubtests, errors.New("no subtest was run, check the command line"), "main")
+	}
+}
+
+func emitBegin(URL string, runtime, interval time.Duration, maxMessageSize int64, testname string) {
+	begin := beginEvent{
+		ClientVersion:  clientVersion(),
+		Interval:       int64(interval / time.Microsecond),
+		MaxMessageSize: maxMessageSize,
+		NoVerify:       *flagNoVerify,
+		Runtime:        int64(runtime / time.Microsecond),
+		Subprotocol:    strings.Join(subprotocols(), ","),
+		URL:            redactURL(URL),
+	}
+	atomic.AddInt64(&subtestsRun, 1)
+	if parsed, err := url.Parse(URL); err == nil {
+		begin.Scheme = parsed.Scheme
+	}
+	if testname == "upload" && randomPayload {
+		begin.PayloadSeed = &payloadSeed
+	}
+	if testname == "download" && *flagReadDelay > 0 {
+		begin.ReadDelay = int64(*flagReadDelay / time.Microsecond)
+	}
+	if testname == "upload" && *flagUploadRamp > 0 {
+		begin.UploadRamp = int64(*flagUploadRamp / time.Microsecond)
+		begin.UploadRampRate = float64(flagUploadRampRate)
+	}
+	emit("Begin", begin, testname)
 }
 
-func emitAppInfo(start time.Time, total int64, testname string) {
-	fmt.Printf(`{"AppInfo":{"NumBytes":%d,"ElapsedTime":%d},"Test":"%s"}`+"\n\n",
-		total, time.Since(start)/time.Microsecond, testname)
+// sensitiveQueryParams lists the query parameters containing credentials.
+var sensitiveQueryParams = []string{"access_token", "key"}
+
+// redactURL returns URL with the password and the sensitive query parameters
+// redacted, so that we can safely write the URL in logs.
+func redactURL(URL string) string {
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return "REDACTED" // better safe than sorry
+	}
+	var redacted bool
+	if _, found := parsed.User.Password(); found {
+		parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+		redacted = true
+	}
+	query := parsed.Query()
+	for name := range query {
+		for _, sensitive := range sensitiveQueryParams {
+			if strings.EqualFold(name, sensitive) {
+				query.Set(name, "REDACTED")
+				redacted = true
+			}
+		}
+	}
+	if !redacted {
+		return URL
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
 }
 
-func downloadTest(ctx context.Context, conn *websocket.Conn) error {
+// redactError returns the error string with any URL redacted, including
+// when the url.Error is wrapped into another error.
+func redactError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		redacted := *urlErr
+		redacted.URL = redactURL(urlErr.URL)
+		return strings.Replace(err.Error(), urlErr.Error(), redacted.Error(), -1)
+	}
+	return err.Error()
+}
+
+func downloadTest(ctx context.Context, clk clock, conn *websocket.Conn) (summary downloadSummary, err error) {
+	if err := checkSubprotocol(conn); err != nil {
+		return summary, err
+	}
 	var total int64
-	start := time.Now()
-	if err := conn.SetReadDeadline(start.Add(maxRuntime)); err != nil {
-		return err
+	start := clk.Now()
+	defer wrapSubtestError(clk, &err, start)
+	if err := conn.SetReadDeadline(start.Add(*flagDuration)); err != nil {
+		return summary, err
 	}
-	conn.SetReadLimit(maxMessageSize)
-	ticker := time.NewTicker(measureInterval)
+	conn.SetReadLimit(*flagMaxMessageSize)
+	ticker := clk.NewTicker(measureInterval)
 	defer ticker.Stop()
+	frameSizes := newFrameSizeHistogram()
+	var readBuffer []byte // with -read-chunk
+	if *flagReadChunk > 0 {
+		readBuffer = make([]byte, *flagReadChunk)
+	}
+	var (
+		intervals     []float64 // bytes per second
+		prevTotal     int64
+		prevTime      = start
+		serverBBRInfo *bbrInfo
+		serverTCPInfo *tcpInfo
+		serverFrames  []json.RawMessage // with -keep-server-frames
+		reads         int64             // with -trace-reads
+		samples       []appInfo
+		ttfb          time.Duration
+		byteLimitTime time.Duration // with -max-bytes
+		code          int
+		reusable      bool
+		// With -analyze-from-bytes, when we reached the offset.
+		analyzeFromBytes int64
+		analyzeFromTime  time.Duration
+	)
+	// The download usually ends because the read deadline expires, so we
+	// emit the summary regardless of how we leave the loop. When draining,
+	// elapsed is set before draining, so the drain time does not count.
+	var elapsed time.Duration
+	defer func() {
+		if elapsed == 0 {
+			elapsed = since(clk, start)
+		}
+		result := newTestResult(elapsed, total)
+		if *flagAnalyzeFromBytes > 0 {
+			result = testResult{} // we did not reach the offset
+			if analyzeFromTime > 0 {
+				result = newTestResult(elapsed-analyzeFromTime, total-analyzeFromBytes)
+			}
+		}
+		summary = downloadSummary{
+			testResult:       result,
+			FrameSizes:       frameSizes,
+			Saturated:        saturated(intervals),
+			ServerBBRInfo:    serverBBRInfo,
+			ServerTCPInfo:    serverTCPInfo,
+			Samples:          samples,
+			ServerFrames:     serverFrames,
+			TTFBMicros:       int64(ttfb / time.Microsecond),
+			ByteLimitTime:    int64(byteLimitTime / time.Microsecond),
+			AnalyzeFromBytes: analyzeFromBytes,
+			AnalyzeFromTime:  int64(analyzeFromTime / time.Microsecond),
+			reusable:         reusable,
+		}
+		summary.CloseCode = code
+		summary.LowConfidence = lowConfidence(len(intervals), "download")
+		emitSummary(summary, "download")
+	}()
+	var transferred int64 // with -sample-interval, updated atomically
+	if *flagSampleInterval > 0 {
+		stop := startByteSampler(clk, start, &transferred)
+		defer stop()
+	}
+	onMeasurement := func(data []byte) {
+		emit("Measurement", serverMeasurement(data), "download")
+		var m measurement
+		if err := json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		if *flagKeepServerFrames {
+			if len(serverFrames) == maxServerFrames {
+				emit("Warning", "reached the maximum number of server frames to keep", "download")
+			}
+			if len(serverFrames) < maxServerFrames {
+				serverFrames = append(serverFrames, data)
+			}
+		}
+		if m.BBRInfo != nil {
+			serverBBRInfo = m.BBRInfo
+		}
+		if m.TCPInfo != nil {
+			serverTCPInfo = m.TCPInfo
+		}
+	}
 	for ctx.Err() == nil {
 		kind, reader, err := conn.NextReader()
+		code = closeCode(err)
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return summary, nil // the server is done with the test
+		}
+		if readDeadlineReached(clk, err, start) {
+			return summary, nil // we stop before the server, with -duration
+		}
 		if err != nil {
-			return err
+			return summary, readLimitError(err)
 		}
 		if kind == websocket.TextMessage {
 			data, err := ioutil.ReadAll(reader)
+			if readDeadlineReached(clk, err, start) {
+				return summary, nil
+			}
 			if err != nil {
-				return err
+				return summary, readLimitError(err)
+			}
+			if *flagCountTextFrames {
+				total += int64(len(data))
 			}
-			total += int64(len(data))
-			fmt.Printf("%s\n", string(data))
+			onMeasurement(data)
 			continue
 		}
-		n, err := io.Copy(ioutil.Discard, reader)
-		if err != nil {
-			return err
+		if ttfb == 0 {
+			ttfb = since(clk, start)
 		}
+		if *flagTraceReads {
+			reader = readTracer{Reader: reader, clk: clk, start: start, count: &reads}
+		}
+		if *flagSampleInterval > 0 {
+			reader = countingReader{Reader: reader, count: &transferred}
+		}
+		if *flagReadDelay > 0 {
+			reader = slowReader{Reader: reader, clk: clk, delay: *flagReadDelay}
+		}
+		n, err := discard(reader, readBuffer)
 		total += int64(n)
+		if readDeadlineReached(clk, err, start) {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, readLimitError(err)
+		}
+		frameSizeHistogramAdd(frameSizes, n)
+		if *flagAnalyzeFromBytes > 0 && analyzeFromTime == 0 && total >= *flagAnalyzeFromBytes {
+			analyzeFromBytes, analyzeFromTime = total, since(clk, start)
+		}
+		if byteLimitReached(total) {
+			if byteLimitTime == 0 {
+				byteLimitTime = since(clk, start)
+			}
+			if since(clk, start) >= *flagMinDuration {
+				elapsed = since(clk, start)
+				drainDownload(clk, conn, onMeasurement)
+				reusable = !*flagDrain
+				return summary, nil
+			}
+		}
+		// In byte-limited mode the deadline only guards against a stalled
+		// server, so the test ends on bytes rather than on wall-clock time.
+		if *flagMaxBytes > 0 && *flagSlidingDeadline {
+			if err := conn.SetReadDeadline(clk.Now().Add(*flagDuration)); err != nil {
+				return summary, err
+			}
+		}
 		select {
-		case <-ticker.C:
-			emitAppInfo(start, total, "download")
+		case now := <-ticker.Chan():
+			sample := emitAppInfo(clk, start, total, "download")
+			if *flagEmbedSamples {
+				samples = append(samples, sample)
+			}
+			intervals = append(intervals, float64(total-prevTotal)/now.Sub(prevTime).Seconds())
+			prevTotal, prevTime = total, now
 		default:
 			// NOTHING
 		}
 	}
-	return nil
+	elapsed = since(clk, start)
+	drainDownload(clk, conn, onMeasurement)
+	return summary, nil
 }
 
-func newMessage(n int) (*websocket.PreparedMessage, error) {
-	return websocket.NewPreparedMessage(websocket.BinaryMessage, make([]byte, n))
+// discard reads and discards the whole reader. When buffer is not nil, we
+// read using it, such that we control the size of each read. Otherwise, we
+// use the buffer of ioutil.Discard, which currently reads 8 KiB at a time.
+func discard(reader io.Reader, buffer []byte) (int64, error) {
+	if buffer == nil {
+		return io.Copy(ioutil.Discard, reader)
+	}
+	// Hide the io.ReaderFrom of ioutil.Discard, which would use its buffer.
+	return io.CopyBuffer(struct{ io.Writer }{ioutil.Discard}, reader, buffer)
 }
 
-func uploadTest(ctx context.Context, conn *websocket.Conn) error {
-	var total int64
-	start := time.Now()
-	if err := conn.SetWriteDeadline(time.Now().Add(maxRuntime)); err != nil {
-		return err
+// closeCode returns the close code of err, if err is the close frame sent
+// by the server, and zero otherwise.
+func closeCode(err error) int {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code
 	}
-	size := minMessageSize
-	message, err := newMessage(size)
-	if err != nil {
-		return err
+	return 0
+}
+
+// readLimitError makes the error returned when a frame exceeds the read
+// limit actionable, since the library error does not say which limit.
+func readLimitError(err error) error {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return fmt.Errorf("server frame exceeded max message size (%d bytes), "+
+			"consider increasing -max-message-size: %w", *flagMaxMessageSize, err)
 	}
-	ticker := time.NewTicker(measureInterval)
-	defer ticker.Stop()
-	for ctx.Err() == nil {
-		if err := conn.WritePreparedMessage(message); err != nil {
-			return err
-		}
-		total += int64(size)
-		select {
-		case <-ticker.C:
-			emitAppInfo(start, total, "upload")
-		default:
-			// NOTHING
+	return err
+}
+
+// drainTimeout bounds the time spent draining the download connection.
+const drainTimeout = 2 * time.Second
+
+// drainDownload reads, with -drain, the frames still in flight after the
+// download is over, until the server's close frame (which the websocket
+// library acknowledges for us) or drainTimeout. This way we also see the
+// final server measurement. Errors just mean that draining is over.
+func drainDownload(clk clock, conn *websocket.Conn, onMeasurement func(data []byte)) {
+	if !*flagDrain {
+		return
+	}
+	if err := conn.SetReadDeadline(clk.Now().Add(drainTimeout)); err != nil {
+		return
+	}
+	for {
+		kind, reader, err := conn.NextReader()
+		if err != nil {
+			return
 		}
-		if int64(size) >= maxScaledMessageSize || int64(size) >= (total/fractionForScaling) {
+		if kind != websocket.TextMessage {
+			if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+				return
+			}
 			continue
 		}
-		size <<= 1
-		if message, err = newMessage(size); err != nil {
-			return err
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return
 		}
+		onMeasurement(data)
+	}
+}
+
+// checkUploadFixedSize validates -upload-fixed-size.
+func checkUploadFixedSize() error {
+	if *flagUploadFixedSize != 0 && (*flagUploadFixedSize < minMessageSize ||
+		*flagUploadFixedSize > maxMessageSize) {
+		return fmt.Errorf("-upload-fixed-size must be within [%d, %d]",
+			minMessageSize, maxMessageSize)
 	}
 	return nil
 }
 
-var (
-	flagDownload = flag.String("download", "", "Download URL")
-	flagNoVerify = flag.Bool("no-verify", false, "No TLS verify")
-	flagUpload   = flag.String("upload", "", "Upload URL")
+// uploadMaxMessageSize returns the largest message the upload may send.
+func uploadMaxMessageSize() int64 {
+	if *flagUploadFixedSize > 0 {
+		return int64(*flagUploadFixedSize)
+	}
+	return maxScaledMessageSize
+}
 
-	flagRoundTrip = flag.String("round-trip", "", "Round trip URL")
-)
+// checkMinDuration validates -min-duration.
+func checkMinDuration() error {
+	if *flagMinDuration > *flagDuration {
+		return errors.New("-min-duration cannot exceed -duration")
+	}
+	return nil
+}
 
-func dialer(ctx context.Context, URL string) (*websocket.Conn, error) {
-	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: *flagNoVerify,
-		},
-		ReadBufferSize:  maxMessageSize,
-		WriteBufferSize: maxMessageSize,
+// byteLimitReached returns whether we have transferred -max-bytes.
+func byteLimitReached(total int64) bool {
+	return *flagMaxBytes > 0 && total >= *flagMaxBytes
+}
+
+// randomPayload is whether the upload payload is random rather than zeroed.
+var randomPayload bool
+
+// payloadSeed is the seed of the random upload payload.
+var payloadSeed int64
+
+// setupPayload configures the upload payload according to the command
+// line. An explicit -payload-seed implies -random-payload. Otherwise, the
+// seed comes from crypto/rand and is reported in the begin event. Each
+// upload starts generating the payload from the seed.
+func setupPayload() error {
+	var seedSet bool
+	flag.Visit(func(f *flag.Flag) {
+		seedSet = seedSet || f.Name == "payload-seed"
+	})
+	if *flagUploadFile != "" {
+		if seedSet || *flagRandomPayload {
+			return errors.New("-upload-file conflicts with random payloads")
+		}
+		return loadPayloadFile(*flagUploadFile)
 	}
-	headers := http.Header{}
-	headers.Add("Sec-WebSocket-Protocol", "net.measurementlab.ndt.v7")
-	conn, _, err := dialer.DialContext(ctx, URL, headers)
-	return conn, err
+	if !seedSet && !*flagRandomPayload {
+		return nil
+	}
+	payloadSeed = *flagPayloadSeed
+	if !seedSet {
+		var data [8]byte
+		if _, err := cryptorand.Read(data[:]); err != nil {
+			return err
+		}
+		payloadSeed = int64(binary.LittleEndian.Uint64(data[:]))
+	}
+	randomPayload = true
+	return nil
+}
+
+// payloadFile contains the -upload-file bytes.
+var payloadFile []byte
+
+func loadPayloadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 1 {
+		return errors.New("-upload-file is empty")
+	}
+	payloadFile = data
+	return nil
 }
 
-func warnx(err error, testname string) {
-	fmt.Printf(`{"Failure":"%s","Test":"%s"}`+"\n\n", err.Error(), testname)
+// payload generates the messages of an upload. Each upload has its own
+// payload, since uploads against several servers may run concurrently.
+type payload struct {
+	rng    *rand.Rand // with random payloads
+	offset int        // where the next message starts reading payloadFile
+	size   int        // size of the cached messages
+	cache  map[int]*websocket.PreparedMessage
 }
 
-func errx(exitcode int, err error, testname string) {
-	warnx(err, testname)
-	os.Exit(exitcode)
+// fileChunk returns n bytes of -upload-file starting at offset, wrapping
+// around as needed.
+func fileChunk(offset, n int) []byte {
+	data := make([]byte, n)
+	for filled, from := 0, offset; filled < n; from = 0 {
+		filled += copy(data[filled:], payloadFile[from:])
+	}
+	return data
 }
 
-const (
-	locateDownloadURL = "wss:///ndt/v7/download"
-	locateUploadURL   = "wss:///ndt/v7/upload"
-)
+// maxPayloadCache is the maximum number of bytes of -upload-file messages
+// that an upload caches, which bounds the memory used with large files.
+const maxPayloadCache = 64 << 20
 
-type locateResponseResult struct {
-	URLs map[string]string `json:"urls"`
+func newPayload() *payload {
+	p := &payload{}
+	if randomPayload {
+		p.rng = rand.New(rand.NewSource(payloadSeed))
+	}
+	return p
 }
 
-type locateResponse struct {
-	Results []locateResponseResult `json:"results"`
+func (p *payload) newMessage(n int) (*websocket.PreparedMessage, error) {
+	if payloadFile != nil {
+		return p.fileMessage(n)
+	}
+	data := make([]byte, n)
+	if p.rng != nil {
+		p.rng.Read(data) // never fails
+	}
+	return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
 }
 
-func locate(ctx context.Context) error {
-	// If you don't specify any option then we use locate. Otherwise we assume
-	// you're testing locally and we only do what you asked us to do.
-	if *flagRoundTrip != "" || *flagDownload != "" || *flagUpload != "" {
-		return nil
+// fileMessage returns the next message of n bytes of -upload-file, which
+// continues from where the previous message stopped, wrapping around as
+// needed, which also repeats the bytes of small files. Since messages with
+// the same size and offset are equal, we prepare each of them only once.
+func (p *payload) fileMessage(n int) (*websocket.PreparedMessage, error) {
+	if n != p.size {
+		p.size, p.cache = n, make(map[int]*websocket.PreparedMessage)
 	}
-	resp, err := http.Get("https://locate.measurementlab.net/v2/nearest/ndt/ndt7")
-	if err != nil {
-		return err
+	offset := p.offset
+	p.offset = (p.offset + n) % len(payloadFile)
+	if message, found := p.cache[offset]; found {
+		return message, nil
 	}
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	message, err := websocket.NewPreparedMessage(websocket.BinaryMessage, fileChunk(offset, n))
 	if err != nil {
-		return err
-	}
-	var locate locateResponse
-	if err := json.Unmarshal(data, &locate); err != nil {
-		return err
+		return nil, err
 	}
-	if len(locate.Results) < 1 {
-		return errors.New("too few entries")
+	if (len(p.cache)+1)*n <= maxPayloadCache {
+		p.cache[offset] = message
 	}
-	// TODO(bassosimone): support flagRoundTrip here when locate v2 is ready
-	*flagDownload = locate.Results[0].URLs[locateDownloadURL]
-	*flagUpload = locate.Results[0].URLs[locateUploadURL]
-	return nil
+	return message, nil
 }
 
-func main() {
-	flag.Parse()
-	ctx := context.Background()
+func uploadTest(ctx context.Context, clk clock, conn *websocket.Conn) (summary uploadSummary, err error) {
+	if err := checkSubprotocol(conn); err != nil {
+		return summary, err
+	}
+	var total int64
+	start := clk.Now()
+	defer wrapSubtestError(clk, &err, start)
+	if err := conn.SetWriteDeadline(clk.Now().Add(*flagDuration)); err != nil {
+		return summary, err
+	}
+	size := minMessageSize
+	if *flagUploadFixedSize > 0 {
+		size = *flagUploadFixedSize
+	}
+	payload := newPayload()
+	message, err := payload.newMessage(size)
+	if err != nil {
+		return summary, err
+	}
+	ticker := clk.NewTicker(measureInterval)
+	defer ticker.Stop()
 	var (
-		conn *websocket.Conn
-		err  error
+		samples       []appInfo
+		numSamples    int
+		byteLimitTime time.Duration // with -max-bytes
 	)
-	if err = locate(ctx); err != nil {
-		errx(1, err, "locate")
-	}
-	if *flagRoundTrip != "" {
-		if conn, err = dialer(ctx, *flagRoundTrip); err != nil {
-			errx(1, err, "roundtrip")
+	measurements := make(chan uploadMeasurements, 1)
+	received := &serverReceived{}
+	serverClosed := make(chan struct{})
+	go readUploadMeasurements(conn, received, serverClosed, measurements)
+	defer func() {
+		client := newTestResult(since(clk, start), total)
+		// Stop reading, or, with -drain, wait for the server to close.
+		deadline := clk.Now()
+		if *flagDrain {
+			deadline = deadline.Add(drainTimeout)
 		}
-		if err = roundTripTest(ctx, conn); err != nil {
-			warnx(err, "roundtrip")
+		conn.SetReadDeadline(deadline)
+		server := <-measurements
+		summary = uploadSummary{
+			testResult:       client,
+			ClientNumBytes:   client.NumBytes,
+			ClientThroughput: client.Throughput,
+			Samples:          samples,
+			ByteLimitTime:    int64(byteLimitTime / time.Microsecond),
 		}
-	}
-	if *flagDownload != "" {
-		if conn, err = dialer(ctx, *flagDownload); err != nil {
+		if server.last != nil && server.last.BytesReceived > 0 && server.last.ElapsedTime > 0 {
+			summary.testResult = newTestResult(
+				time.Duration(server.last.ElapsedTime)*time.Microsecond, server.last.BytesReceived)
+		}
+		summary.CloseCode = server.closeCode
+		summary.LowConfidence = lowConfidence(numSamples, "upload")
+		emitSummary(summary, "upload")
+	}()
+	for ctx.Err() == nil {
+		if *flagUploadStopOnClose && isClosed(serverClosed) {
+			return summary, nil // the server is done with the test
+		}
+		if err := conn.WritePreparedMessage(message); err != nil {
+			if deadlineReached(clk, err, start) {
+				return summary, nil // this is how the upload normally ends
+			}
+			if *flagUploadStopOnClose && isClosed(serverClosed) {
+				return summary, nil // the write failed because the server closed
+			}
+			return summary, err
+		}
+		total += int64(size)
+		if byteLimitReached(total) {
+			if byteLimitTime == 0 {
+				byteLimitTime = since(clk, start)
+			}
+			if since(clk, start) >= *flagMinDuration {
+				return summary, nil
+			}
+		}
+		select {
+		case <-ticker.Chan():
+			numSamples++
+			sample := newAppInfo(clk, start, total)
+			sample.ServerThroughput = received.Throughput()
+			emit("AppInfo", sample, "upload")
+			if *flagEmbedSamples {
+				samples = append(samples, sample)
+			}
+		default:
+			// NOTHING
+		}
+		if payloadFile != nil {
+			// Get the next chunk of the file, which is cached, hence cheap.
+			if message, err = payload.newMessage(size); err != nil {
+				return summary, err
+			}
+		}
+		if rampUpload(clk, start, total) {
+			continue // like when pacing, we do not scale the message size
+		}
+		if *flagUploadFixedSize > 0 {
+			continue
+		}
+		if flagUploadRate > 0 {
+			// When pacing we want a controlled bitrate rather than saturating
+			// the link, hence we do not scale the message size.
+			paceUpload(clk, start, total, float64(flagUploadRate))
+			continue
+		}
+		if int64(size) >= maxScaledMessageSize || int64(size) >= (total/fractionForScaling) {
+			continue
+		}
+		size <<= 1
+		if message, err = payload.newMessage(size); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// uploadMeasurements is what readUploadMeasurements read.
+type uploadMeasurements struct {
+	last      *tcpInfo // the last TCPInfo measured by the server
+	closeCode int
+}
+
+// serverReceived is the throughput the server measured during the upload,
+// which readUploadMeasurements updates while the upload runs.
+type serverReceived struct {
+	mu         sync.Mutex
+	throughput float64 // bit/s
+}
+
+func (r *serverReceived) Throughput() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.throughput
+}
+
+func (r *serverReceived) update(info *tcpInfo) {
+	if info.BytesReceived <= 0 || info.ElapsedTime <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.throughput = float64(info.BytesReceived*8) / (float64(info.ElapsedTime) / 1e06)
+}
+
+// readUploadMeasurements reads the measurements the server sends during the
+// upload, until reading fails, updating received, and then sends the last
+// one on done. Since the upload only writes, and gorilla/websocket supports
+// one concurrent reader and one concurrent writer, this is safe. When the
+// server closes, it closes serverClosed and, with -upload-stop-on-close,
+// interrupts any pending write, such that the upload stops immediately.
+func readUploadMeasurements(conn *websocket.Conn, received *serverReceived,
+	serverClosed chan<- struct{}, done chan<- uploadMeasurements) {
+	var result uploadMeasurements
+	defer func() { done <- result }()
+	for {
+		kind, reader, err := conn.NextReader()
+		if err != nil {
+			result.closeCode = closeCode(err)
+			if result.closeCode != 0 {
+				close(serverClosed)
+				if *flagUploadStopOnClose {
+					conn.UnderlyingConn().SetWriteDeadline(time.Now())
+				}
+			}
+			return
+		}
+		if kind != websocket.TextMessage {
+			continue // we do not expect binary messages, just skip them
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return
+		}
+		emit("Measurement", serverMeasurement(data), "upload")
+		var m measurement
+		if err := json.Unmarshal(data, &m); err == nil && m.TCPInfo != nil {
+			result.last = m.TCPInfo
+			received.update(m.TCPInfo)
+		}
+	}
+}
+
+// isClosed returns whether the channel is closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// deadlineReached returns whether err is the timeout caused by the write
+// deadline that we set to stop the upload after the runtime.
+func deadlineReached(clk clock, err error, start time.Time) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() && since(clk, start) >= *flagDuration
+}
+
+// readDeadlineReached is like deadlineReached for the read deadline that
+// stops the download, which only fires before the server closes when
+// -duration is shorter than the server's runtime. With -sliding-deadline,
+// instead, the deadline expiring means that the server stalled.
+func readDeadlineReached(clk clock, err error, start time.Time) bool {
+	if *flagMaxBytes > 0 && *flagSlidingDeadline {
+		return false
+	}
+	return deadlineReached(clk, err, start)
+}
+
+// paceUpload sleeps until sending total bytes at rate bit/s is on schedule.
+func paceUpload(clk clock, start time.Time, total int64, rate float64) {
+	expected := time.Duration(float64(total*8) / rate * float64(time.Second))
+	if delay := expected - since(clk, start); delay > 0 {
+		clk.Sleep(delay)
+	}
+}
+
+// checkUploadRamp validates -upload-ramp and -upload-ramp-rate, which
+// defaults to -upload-rate, since we need to know the final rate.
+func checkUploadRamp() error {
+	if *flagUploadRamp <= 0 {
+		return nil
+	}
+	if flagUploadRampRate <= 0 {
+		flagUploadRampRate = flagUploadRate
+	}
+	if flagUploadRampRate <= 0 {
+		return errors.New("-upload-ramp needs -upload-ramp-rate or -upload-rate")
+	}
+	return nil
+}
+
+// rampUpload sleeps, with -upload-ramp, until sending total bytes is on
+// schedule with a rate growing linearly from zero to -upload-ramp-rate over
+// -upload-ramp. The bits sent at time t are rate*t*t/(2*ramp), so the ramp
+// ends after rate*ramp/2 bits. It returns whether we are still ramping up.
+func rampUpload(clk clock, start time.Time, total int64) bool {
+	if *flagUploadRamp <= 0 {
+		return false
+	}
+	rate, ramp := float64(flagUploadRampRate), flagUploadRamp.Seconds()
+	bits := float64(total * 8)
+	if bits >= rate*ramp/2 {
+		return false
+	}
+	expected := time.Duration(math.Sqrt(2*ramp*bits/rate) * float64(time.Second))
+	if delay := expected - since(clk, start); delay > 0 {
+		clk.Sleep(delay)
+	}
+	return true
+}
+
+// bitrate is a flag.Value parsing bitrates such as 500kbit or 5Mbit.
+type bitrate float64
+
+func (br *bitrate) String() string {
+	return fmt.Sprintf("%gbit", float64(*br))
+}
+
+func (br *bitrate) Set(s string) error {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"gbit", 1e09},
+		{"mbit", 1e06},
+		{"kbit", 1e03},
+		{"bit", 1},
+	}
+	lower := strings.ToLower(s)
+	for _, unit := range units {
+		if !strings.HasSuffix(lower, unit.suffix) {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSuffix(lower, unit.suffix), 64)
+		if err != nil {
+			return err
+		}
+		if value <= 0 {
+			return errors.New("bitrate must be positive")
+		}
+		*br = bitrate(value * unit.multiplier)
+		return nil
+	}
+	return errors.New("bitrate must end with bit, kbit, Mbit, or Gbit")
+}
+
+var (
+	flagUploadRate     bitrate
+	flagUploadRampRate bitrate
+)
+
+// tags is a flag.Value collecting repeated key=value pairs.
+type tags map[string]string
+
+func (t tags) String() string {
+	var pairs []string
+	for key, value := range t {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t tags) Set(s string) error {
+	idx := strings.Index(s, "=")
+	if idx <= 0 {
+		return errors.New("tag must be in the key=value form")
+	}
+	t[s[:idx]] = s[idx+1:]
+	return nil
+}
+
+var flagTags = make(tags)
+
+func init() {
+	flag.Var(&flagUploadRate, "upload-rate", "Pace the upload at this rate (e.g. 5Mbit)")
+	flag.Var(&flagUploadRampRate, "upload-ramp-rate", "Rate reached at the end of -upload-ramp (default -upload-rate)")
+	flag.Var(flagTags, "tag", "Attach this key=value pair to the events (may be repeated)")
+}
+
+var (
+	flagDownload         = flag.String("download", "", "Download URL")
+	flagNoVerify         = flag.Bool("no-verify", false, "No TLS verify")
+	flagPinSHA256        = flag.String("pin-sha256", "", "Base64 SHA-256 of the server certificate or of its public key")
+	flagUpload           = flag.String("upload", "", "Upload URL")
+	flagFormat           = flag.String("format", "json", "Output format: json, influx, logline, or protobuf")
+	flagGrouped          = flag.Bool("grouped", false, "Omit the Test field of the JSON events and emit it when the test changes")
+	flagUnits            = flag.String("units", "", "Also express summary throughput in mbit, mbyte, or gbit")
+	flagLineBuffered     = flag.Bool("line-buffered", true, "Flush the output after each event, rather than buffering it")
+	flagSamplesOut       = flag.String("samples-out", "", "Write per-interval samples to this file")
+	flagSummaryOut       = flag.String("summary-out", "", "Write summaries to this file")
+	flagSyslog           = flag.Bool("syslog", false, "Write the events to syslog rather than to the standard output")
+	flagSyslogAddr       = flag.String("syslog-addr", "", "With -syslog, use this remote syslog (e.g. udp://host:514)")
+	flagEmbedSamples     = flag.Bool("embed-samples", false, "Include the AppInfo samples in the download and upload summaries")
+	flagKeepServerFrames = flag.Bool("keep-server-frames", false, "Include the server measurements in the download summary")
+	flagQuietOnSuccess   = flag.Bool("quiet-on-success", false, "Only emit failures and exit non-zero if a subtest fails")
+	flagProgress         = flag.Bool("progress", false, "Include the percentage of completion in AppInfo")
+	flagPrintOnly        = flag.String("print-only", "", "Only print download-mbit, upload-mbit, or min-rtt-ms")
+	flagCorrelationID    = flag.String("correlation-id", "", "Include this ID in every event and send it to the server")
+
+	flagRoundTrip = flag.String("round-trip", "", "Round trip URL")
+
+	flagAlternate = flag.Bool("alternate", false, "Alternate download and upload bursts for -duration")
+	flagBurst     = flag.Duration("burst", 2*time.Second, "Duration of each -alternate burst")
+	flagColdWarm  = flag.Bool("cold-warm", false, "Run two back-to-back downloads and compare them")
+
+	flagMinDownloadMbit    = flag.Float64("min-download-mbit", 0, "Warn when the download throughput is below this")
+	flagMinUploadMbit      = flag.Float64("min-upload-mbit", 0, "Warn when the upload throughput is below this")
+	flagLowThroughputFails = flag.Bool("low-throughput-fails", false,
+		"Exit with a non-zero code when the throughput is below the minimum")
+
+	flagMinSamples         = flag.Int("min-samples", 0, "Mark download and upload with fewer samples as low confidence")
+	flagLowConfidenceFails = flag.Bool("low-confidence-fails", false,
+		"Exit with a non-zero code when a subtest has fewer than -min-samples samples")
+
+	flagMaxRTT           = flag.Duration("max-rtt", 0, "Skip the other subtests if the round trip min RTT exceeds this")
+	flagLatencyUnderLoad = flag.Bool("latency-under-load", false,
+		"Compare the idle round trip RTT with the RTT during a download")
+	flagSmoke           = flag.Bool("smoke", false, "Run short subtests and fail unless all of them work")
+	flagRoundTripCount  = flag.Int("roundtrip-count", 0, "Stop the round trip test after this many samples")
+	flagRoundTripWarmup = flag.Int("roundtrip-warmup", 0, "Exclude this many initial round trip samples from the statistics")
+	flagFrameTiming     = flag.Bool("frame-timing", false, "Include the time between round trip messages in the summary")
+	flagRoundTripStats  = flag.Bool("roundtrip-stats", false, "Periodically emit the round trip RTT statistics so far")
+
+	flagMaxConnectAttempts = flag.Int("max-connect-attempts", 1,
+		"Number of attempts to connect, running locate again between attempts")
+	flagCloseTimeout = flag.Duration("close-timeout", 2*time.Second,
+		"Maximum time to wait for the server to acknowledge closing the connection")
+
+	flagAllowNDT5Fallback = flag.Bool("allow-ndt5-fallback", false,
+		"Run ndt5 download and upload when the server does not speak ndt7")
+
+	flagRandomPayload     = flag.Bool("random-payload", false, "Upload random rather than zeroed bytes")
+	flagPayloadSeed       = flag.Int64("payload-seed", 0, "Seed for -random-payload (implies -random-payload)")
+	flagUploadFixedSize   = flag.Int("upload-fixed-size", 0, "Use this upload message size rather than scaling it")
+	flagUploadFile        = flag.String("upload-file", "", "Upload the content of this file, repeated as needed")
+	flagUploadStopOnClose = flag.Bool("upload-stop-on-close", false,
+		"Stop the upload as soon as the server closes the connection")
+	flagUploadRamp = flag.Duration("upload-ramp", 0, "Linearly increase the upload rate over this period")
+
+	flagTraceReads    = flag.Bool("trace-reads", false, "Emit a Read event for each read of the download (a lot of output)")
+	flagTraceReadsMax = flag.Int64("trace-reads-max", 100000, "Maximum number of reads to emit with -trace-reads")
+
+	flagSampleInterval = flag.Duration("sample-interval", 0,
+		"Emit the bytes downloaded so far at this interval (e.g. 10ms), regardless of the messages")
+
+	flagSelectByRTT  = flag.Bool("select-by-rtt", false, "With locate, use the result with the lowest connect time")
+	flagSameServer   = flag.Bool("same-server", false, "With locate, run all subtests against the same server")
+	flagRandomServer = flag.Bool("random-server", false, "With locate, use a random result rather than the nearest")
+
+	flagWebhook        = flag.String("webhook", "", "POST the report to this URL")
+	flagWebhookAuth    = flag.String("webhook-auth", "", "Authorization header for -webhook")
+	flagWebhookTimeout = flag.Duration("webhook-timeout", 10*time.Second, "Timeout for -webhook")
+
+	flagTrace = flag.Bool("trace", false, "Emit a Trace event for each step of connecting")
+
+	flagRepeat         = flag.Int("repeat", 1, "Run the whole suite this many times")
+	flagRepeatInterval = flag.Duration("repeat-interval", 0, "Time to wait between -repeat iterations")
+
+	flagSuiteRetries    = flag.Int("suite-retries", 0, "Run the whole suite again up to this many times on any failure")
+	flagSuiteRetryDelay = flag.Duration("suite-retry-delay", 5*time.Second,
+		"Time to wait before the first -suite-retries retry, doubling at each retry")
+
+	flagBind       = flag.String("bind", "", "Local address to bind to, e.g. 192.0.2.1 or fe80::1%eth0")
+	flagDNS        = flag.String("dns", "", "DNS server to use, e.g. 192.0.2.53 or 192.0.2.53:5353")
+	flagCongestion = flag.String("congestion", "", "TCP congestion control algorithm, e.g. bbr or cubic (Linux only)")
+	flagSoRcvBuf   = flag.Int("so-rcvbuf", 0, "Size of the socket receive buffer (Linux and BSD only)")
+	flagSoSndBuf   = flag.Int("so-sndbuf", 0, "Size of the socket send buffer (Linux and BSD only)")
+
+	flagLocateMaxSize  = flag.Int64("locate-max-size", 1<<20, "Maximum size of the locate response")
+	flagDumpLocate     = flag.Bool("dump-locate", false, "Emit the locate response, with the tokens redacted")
+	flagLocateMetadata = flag.Bool("locate-metadata", false,
+		"Without locate, ask locate for the location of the server in the URLs")
+	flagSoftLocateFail = flag.Bool("soft-locate-fail", false,
+		"Exit with code 8 rather than failing when locate returns no server")
+
+	flagPrintConfig = flag.Bool("print-config", false, "Print the configuration as JSON and exit")
+	flagVersion     = flag.Bool("version", false, "Print the client version and exit")
+
+	flagPrewarm = flag.Bool("prewarm", false,
+		"Resolve the download and upload hosts in the background at startup")
+
+	flagTestTopN    = flag.Int("test-top-n", 0, "Run download and upload against the N nearest locate results")
+	flagConcurrency = flag.Int("concurrency", 1,
+		"Number of servers tested concurrently with -test-top-n or -servers-file")
+	flagServersFile = flag.String("servers-file", "", "Run download and upload against each server in this file")
+
+	flagUserAgent = flag.String("user-agent", "ndt7-client-go-minimal/"+clientVersion(),
+		"User-Agent header to send to the server")
+	flagSubprotocols = flag.String("subprotocols", subprotocol,
+		"Comma separated list of WebSocket subprotocols to advertise")
+	flagRequireServerVersion = flag.String("require-server-version", "",
+		"Fail to connect to servers older than this version (e.g. 0.20.0)")
+
+	// Running several subtests over a single connection is not part of the
+	// ndt7 specification and standard servers will not support it.
+	flagReuseConn = flag.Bool("reuse-conn", false,
+		"Experimental: run upload over the download connection when both use the same host and "+
+			"the download stopped at -max-bytes without -drain, hence without closing")
+
+	flagClock            = flag.String("clock", "mono", "Compute the elapsed times using the wall or the mono(tonic) clock")
+	flagDuration         = flag.Duration("duration", maxRuntime, "Download and upload runtime")
+	flagReadDelay        = flag.Duration("read-delay", 0, "Sleep this long after each download read to simulate a slow reader")
+	flagReadChunk        = flag.Int("read-chunk", 0, "Read the download messages using a buffer of this size")
+	flagCountTextFrames  = flag.Bool("count-text-frames", false, "Count the download measurement messages as downloaded bytes")
+	flagMaxMessageSize   = flag.Int64("max-message-size", maxMessageSize, "Maximum size of the download messages")
+	flagMinDuration      = flag.Duration("min-duration", 0, "With -max-bytes, keep transferring for at least this long")
+	flagAnalyzeFromBytes = flag.Int64("analyze-from-bytes", 0,
+		"Exclude the initial download bytes up to this offset from the summary throughput")
+	flagMaxBytes        = flag.Int64("max-bytes", 0, "Stop download and upload after this many bytes")
+	flagDrain           = flag.Bool("drain", false, "Read the remaining server frames until the server closes")
+	flagSlidingDeadline = flag.Bool("sliding-deadline", false,
+		"With -max-bytes, refresh the download deadline after each read")
+
+	// The default of -fail-fast is taken from NDT7_FAIL_FAST such that
+	// wrapper scripts can change it without rewriting the command line.
+	flagFailFast = flag.Bool("fail-fast", os.Getenv("NDT7_FAIL_FAST") == "1",
+		"Skip remaining subtests after a failure (default from NDT7_FAIL_FAST=1)")
+)
+
+const subprotocol = "net.measurementlab.ndt.v7"
+
+// subprotocols returns the -subprotocols to advertise, ignoring the spaces
+// around each of them and the empty ones.
+func subprotocols() []string {
+	var out []string
+	for _, entry := range strings.Split(*flagSubprotocols, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+func dialer(ctx context.Context, URL string) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: *flagNoVerify,
+		},
+		ReadBufferSize:  maxMessageSize,
+		WriteBufferSize: maxMessageSize,
+		Subprotocols:    subprotocols(),
+	}
+	if pinnedSHA256 != nil {
+		// The pin replaces the verification using the system CAs.
+		dialer.TLSClientConfig.InsecureSkipVerify = true
+		dialer.TLSClientConfig.VerifyPeerCertificate = verifyPin
+	}
+	dialer.NetDialContext = newNetDialer().DialContext
+	if *flagPrewarm {
+		dialer.NetDialContext = defaultPrewarmer.DialContext
+	}
+	headers := http.Header{}
+	if *flagUserAgent != "" {
+		headers.Set("User-Agent", *flagUserAgent)
+	}
+	if *flagCorrelationID != "" {
+		headers.Set("X-Correlation-ID", *flagCorrelationID)
+	}
+	conn, resp, err := dialer.DialContext(ctx, URL, headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkServerVersion(resp.Header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// warnNoVerify emits a warning, also on the standard error, if -no-verify
+// disables authenticating the server, such that the logs show that. With
+// -pin-sha256, instead, we still authenticate the server using the pin.
+func warnNoVerify() {
+	if !*flagNoVerify || pinnedSHA256 != nil {
+		return
+	}
+	const message = "-no-verify disables TLS certificate verification, the server is not authenticated"
+	emit("Warning", message, "main")
+	if eventsWriter != os.Stderr {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", message)
+	}
+}
+
+// checkSubprotocol ensures that the server selected a subprotocol whose
+// semantics we implement. Support for other ndt7 versions goes here.
+func checkSubprotocol(conn *websocket.Conn) error {
+	switch conn.Subprotocol() {
+	case subprotocol:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errSubprotocolMismatch, conn.Subprotocol())
+	}
+}
+
+// errx reports err and exits with exitcode. When the user interrupted us,
+// which is not a failure, it just exits with exitInterrupted.
+func errx(exitcode int, err error, testname string) {
+	if errors.Is(err, context.Canceled) {
+		exit(exitInterrupted)
+	}
+	warnx(err, testname)
+	exit(exitcode)
+}
+
+// Exit codes used with -fail-fast when a subtest fails.
+const (
+	exitRoundTripFailed = 2
+	exitDownloadFailed  = 3
+	exitUploadFailed    = 4
+)
+
+// exitRTTTooHigh is the exit code used when the RTT exceeds -max-rtt.
+const exitRTTTooHigh = 5
+
+// checkMaxRTT exits, skipping the remaining subtests, if the minimum RTT
+// observed during the round-trip test exceeds -max-rtt.
+func checkMaxRTT(summary roundTripSummary) {
+	minRTT := time.Duration(summary.MinSRTT * float64(time.Microsecond))
+	if *flagMaxRTT <= 0 || minRTT <= *flagMaxRTT {
+		return
+	}
+	emit("Abort", fmt.Sprintf("min RTT %s exceeds -max-rtt %s", minRTT, *flagMaxRTT), "roundtrip")
+	exit(exitRTTTooHigh)
+}
+
+// exitThroughputTooLow is the exit code used, with -low-throughput-fails,
+// when the throughput is below -min-download-mbit or -min-upload-mbit.
+const exitThroughputTooLow = 6
+
+// anyLowThroughput is whether the throughput of any subtest was below the
+// minimum. Since servers may be tested concurrently, it is accessed atomically.
+var anyLowThroughput int32
+
+// belowMinThroughput returns whether result is below minMbit, if set, and
+// emits a warning in such a case.
+func belowMinThroughput(result testResult, minMbit float64, testname string) bool {
+	mbit := result.Throughput / 1e06
+	if minMbit <= 0 || mbit >= minMbit {
+		return false
+	}
+	emit("Warning", fmt.Sprintf("%s throughput %.2f Mbit/s is below the minimum %.2f Mbit/s",
+		testname, mbit, minMbit), testname)
+	atomic.StoreInt32(&anyLowThroughput, 1)
+	return true
+}
+
+// checkLowThroughputFails rejects -low-throughput-fails with the modes that
+// do not check the throughput against the minimum.
+func checkLowThroughputFails() error {
+	if *flagLowThroughputFails && (*flagAlternate || *flagColdWarm || *flagSmoke || *flagLatencyUnderLoad) {
+		return errors.New("-low-throughput-fails conflicts with -alternate, -cold-warm, -smoke, and -latency-under-load")
+	}
+	return nil
+}
+
+// exitOnLowResults exits, with -low-throughput-fails or -low-confidence-fails,
+// when any subtest was below the minimum throughput or had too few samples.
+func exitOnLowResults() {
+	if atomic.LoadInt32(&anyLowThroughput) != 0 && *flagLowThroughputFails {
+		exit(exitThroughputTooLow)
+	}
+	if atomic.LoadInt32(&anyLowConfidence) != 0 && *flagLowConfidenceFails {
+		exit(exitLowConfidence)
+	}
+}
+
+// subtestFailed reports a subtest failure and, with -fail-fast, exits
+// using the exit code specific to the failed subtest.
+func subtestFailed(exitcode int, err error, testname string) {
+	if *flagFailFast {
+		errx(exitcode, err, testname)
+	}
+	if failedExitCode == 0 {
+		failedExitCode = exitcode
+	}
+	suiteFailed = true
+	warnx(err, testname)
+}
+
+// failedExitCode is the exit code of the first failed subtest, which we use
+// with -quiet-on-success, since the exit code is all that tells apart a
+// failed run when there is no output.
+var failedExitCode int
+
+// suiteFailed tells whether connecting or running a subtest of the running
+// suite failed, which is what -suite-retries retries. Unlike counting the
+// Failure events, it ignores the errors that do not fail a subtest, e.g.,
+// failing to POST to -webhook or ndt7 failing before the ndt5 fallback.
+var suiteFailed bool
+
+const (
+	locateDownloadURL = "wss:///ndt/v7/download"
+	locateUploadURL   = "wss:///ndt/v7/upload"
+)
+
+type locateResponseResult struct {
+	Machine  string            `json:"machine"`
+	Location *locateLocation   `json:"location"`
+	URLs     map[string]string `json:"urls"`
+}
+
+type locateResponse struct {
+	Results []locateResponseResult `json:"results"`
+}
+
+// errNoLocateResults indicates that locate did not return any server.
+var errNoLocateResults = errors.New("too few entries")
+
+// exitNoLocateResults is the exit code used, with -soft-locate-fail, when
+// locate does not return any server.
+const exitNoLocateResults = 8
+
+// locateFailed reports that running locate failed. With -soft-locate-fail,
+// no server being available is a warning with its own exit code, such that
+// a supervisor can retry later rather than alerting.
+func locateFailed(err error) {
+	if *flagSoftLocateFail && errors.Is(err, errNoLocateResults) {
+		emit("Warning", "locate did not return any server", "locate")
+		exit(exitNoLocateResults)
+	}
+	errx(1, err, "locate")
+}
+
+// locateNeeded returns whether we should use locate. If you don't specify
+// any option then we use locate. Otherwise we assume you're testing locally
+// and we only do what you asked us to do. With -test-top-n, testTopN runs
+// locate itself, since it needs all the results, while -latency-under-load
+// needs the round-trip URL, which locate does not return.
+func locateNeeded() bool {
+	return *flagRoundTrip == "" && *flagDownload == "" && *flagUpload == "" &&
+		*flagServersFile == "" && *flagTestTopN <= 0 && !*flagLatencyUnderLoad
+}
+
+// locateResults queries locate and returns its results, the nearest first.
+func locateResults(ctx context.Context) ([]locateResponseResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"https://locate.measurementlab.net/v2/nearest/ndt/ndt7", nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: newHTTPTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Read one byte more than the limit so we can tell a body exactly as
+	// large as the limit apart from a truncated one.
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, *flagLocateMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > *flagLocateMaxSize {
+		return nil, fmt.Errorf("locate response too large (more than %d bytes)", *flagLocateMaxSize)
+	}
+	if *flagDumpLocate {
+		dumpLocate(data)
+	}
+	var locate locateResponse
+	if err := json.Unmarshal(data, &locate); err != nil {
+		return nil, err
+	}
+	if len(locate.Results) < 1 {
+		return nil, errNoLocateResults
+	}
+	return locate.Results, nil
+}
+
+// dumpLocate emits the locate response as is, except for the redacted URLs,
+// to debug locate. We emit a string when the response is not JSON.
+func dumpLocate(data []byte) {
+	var response interface{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		emit("LocateResponse", string(data), "locate")
+		return
+	}
+	emit("LocateResponse", redactURLs(response), "locate")
+}
+
+// redactURLs returns value, as parsed by encoding/json, with redactURL
+// applied to all the strings.
+func redactURLs(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactURL(v)
+	case []interface{}:
+		for idx := range v {
+			v[idx] = redactURLs(v[idx])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = redactURLs(v[key])
+		}
+	}
+	return value
+}
+
+// checkLocateResult ensures that result contains the URLs we need.
+func checkLocateResult(result locateResponseResult) error {
+	// TODO(bassosimone): support flagRoundTrip here when locate v2 is ready
+	for _, key := range []string{locateDownloadURL, locateUploadURL} {
+		if result.URLs[key] == "" {
+			return fmt.Errorf("locate response lacks the %s URL", key)
+		}
+	}
+	return nil
+}
+
+func locate(ctx context.Context) error {
+	results, err := locateResults(ctx)
+	if err != nil {
+		return err
+	}
+	result := results[0]
+	if *flagRandomServer && (!*flagSameServer || locatedMachine == "") {
+		if result, err = randomLocateResult(results); err != nil {
+			return err
+		}
+	}
+	if *flagSelectByRTT && (!*flagSameServer || locatedMachine == "") {
+		var valid []locateResponseResult
+		for _, r := range results {
+			if checkLocateResult(r) == nil {
+				valid = append(valid, r)
+			}
+		}
+		if len(valid) > 0 {
+			if result, err = selectByRTT(ctx, valid); err != nil {
+				return err
+			}
+		}
+	}
+	if *flagSameServer && locatedMachine != "" {
+		// Get fresh URLs for the same server, rather than the nearest one,
+		// so that all subtests measure the same server.
+		var found bool
+		for _, result = range results {
+			if found = locateResultServer(result) == locatedMachine; found {
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("locate no longer returns %s", locatedMachine)
+		}
+	}
+	if err := checkLocateResult(result); err != nil {
+		return err
+	}
+	*flagDownload = result.URLs[locateDownloadURL]
+	*flagUpload = result.URLs[locateUploadURL]
+	locatedMachine = locateResultServer(result)
+	serverLocation = result.Location
+	return nil
+}
+
+// randomLocateResult returns a random result, to spread the load of many
+// clients over the servers. We use crypto/rand since clients starting at
+// the same time would otherwise likely have the same seed.
+func randomLocateResult(results []locateResponseResult) (locateResponseResult, error) {
+	idx, err := cryptorand.Int(cryptorand.Reader, big.NewInt(int64(len(results))))
+	if err != nil {
+		return locateResponseResult{}, err
+	}
+	return results[idx.Int64()], nil
+}
+
+// locateResultServer returns the name of the server of result.
+func locateResultServer(result locateResponseResult) string {
+	if result.Machine != "" {
+		return result.Machine
+	}
+	if parsed, err := url.Parse(result.URLs[locateDownloadURL]); err == nil {
+		return parsed.Hostname()
+	}
+	return ""
+}
+
+// locatedMachine is the name of the machine selected by locate, if any.
+var locatedMachine string
+
+// connect dials URL, making up to -max-connect-attempts attempts. Between
+// attempts it emits a Warning, sleeps with full jitter backoff, returning
+// early on SIGINT, and, when useLocate is true, it runs locate again, which
+// may update URL to point to another server.
+func connect(ctx context.Context, URL *string, useLocate bool, testname string) (*websocket.Conn, error) {
+	if *flagTrace {
+		ctx = withTrace(ctx, testname)
+	}
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer(ctx, *URL)
+		if err == nil {
+			emitConnect(conn, testname)
+		}
+		if err == nil || attempt >= *flagMaxConnectAttempts {
+			return conn, err
+		}
+		// Only the last attempt may fail the subtest, hence the others
+		// are just warnings, unless the user interrupted us.
+		checkInterrupted()
+		emit("Warning", fmt.Sprintf("connect attempt %d of %d failed: %s",
+			attempt, *flagMaxConnectAttempts, redactError(err)), testname)
+		sleep(ctx, backoff(attempt))
+		checkInterrupted()
+		if useLocate {
+			if err := locate(ctx); err != nil {
+				checkInterrupted()
+				emit("Warning", fmt.Sprintf("locate failed, reusing the previous server: %s",
+					redactError(err)), "locate")
+			}
+		}
+	}
+}
+
+// closeConn sends a close frame and waits for the close frame of the server
+// for at most -close-timeout, since a misbehaving server may never send it,
+// and then closes the connection. Errors just mean that closing is over.
+func closeConn(conn *websocket.Conn) {
+	defer conn.Close()
+	deadline := time.Now().Add(*flagCloseTimeout)
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := conn.WriteControl(websocket.CloseMessage, message, deadline); err != nil {
+		return
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return
+	}
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return // including the close frame of the server
+		}
+	}
+}
+
+// connectEvent describes an established connection.
+type connectEvent struct {
+	LocalAddr          string
+	RemoteAddr         string
+	TLS                bool
+	NegotiatedProtocol string           `json:",omitempty"` // TLS ALPN
+	SocketBuffers      *socketBuffers   `json:",omitempty"` // with -so-rcvbuf or -so-sndbuf
+	Certificate        *certificateInfo `json:",omitempty"` // leaf, for TLS connections
+}
+
+// certificateInfo describes a certificate, for auditing the servers.
+type certificateInfo struct {
+	Subject   string
+	Issuer    string
+	NotBefore string   // RFC3339
+	NotAfter  string   // RFC3339
+	SANs      []string `json:",omitempty"` // DNS names and IP addresses
+}
+
+func newCertificateInfo(cert *x509.Certificate) *certificateInfo {
+	info := &certificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore.Format(time.RFC3339),
+		NotAfter:  cert.NotAfter.Format(time.RFC3339),
+		SANs:      append([]string{}, cert.DNSNames...),
+	}
+	for _, addr := range cert.IPAddresses {
+		info.SANs = append(info.SANs, addr.String())
+	}
+	return info
+}
+
+func emitConnect(conn *websocket.Conn, testname string) {
+	ev := connectEvent{
+		LocalAddr:  conn.LocalAddr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		ev.TLS = true
+		state := tlsConn.ConnectionState()
+		ev.NegotiatedProtocol = state.NegotiatedProtocol
+		if len(state.PeerCertificates) > 0 {
+			ev.Certificate = newCertificateInfo(state.PeerCertificates[0])
+		}
+	}
+	if *flagSoRcvBuf > 0 || *flagSoSndBuf > 0 {
+		buffers := socketBuffersApplied()
+		ev.SocketBuffers = &buffers
+	}
+	emit("Connect", ev, testname)
+	if ev.NegotiatedProtocol == "h2" {
+		// We do not implement WebSocket over HTTP/2 (RFC 8441).
+		emit("Warning", "ALPN negotiated h2, the upgrade may behave oddly", testname)
+	}
+}
+
+// backoff returns a random delay between zero and an exponentially growing
+// bound, which spreads the reconnections of many clients over time.
+func backoff(attempt int) time.Duration {
+	bound := maxBackoff
+	if attempt < 16 && minBackoff<<uint(attempt) < maxBackoff {
+		bound = minBackoff << uint(attempt)
+	}
+	return time.Duration(rand.Int63n(int64(bound)))
+}
+
+// sameHost returns whether two URLs refer to the same host and port.
+func sameHost(first, second string) bool {
+	firstURL, err := url.Parse(first)
+	if err != nil {
+		return false
+	}
+	secondURL, err := url.Parse(second)
+	if err != nil {
+		return false
+	}
+	return firstURL.Host == secondURL.Host
+}
+
+// report aggregates the results of all the subtests.
+type report struct {
+	ClientVersion string
+	Server        string
+	Location      *locateLocation   `json:",omitempty"`
+	StartTime     string            // RFC3339
+	EndTime       string            // RFC3339
+	Download      *downloadSummary  `json:",omitempty"`
+	Upload        *uploadSummary    `json:",omitempty"`
+	RoundTrip     *roundTripSummary `json:",omitempty"`
+	// AsymmetryRatio is the download throughput divided by the upload
+	// throughput, when both are available.
+	AsymmetryRatio float64 `json:",omitempty"`
+}
+
+// reportServer returns the name of the server we have tested, which is
+// the machine name when using locate and the host name otherwise.
+func reportServer() string {
+	if locatedMachine != "" {
+		return locatedMachine
+	}
+	for _, URL := range []string{*flagDownload, *flagUpload, *flagRoundTrip} {
+		if parsed, err := url.Parse(URL); err == nil && parsed.Hostname() != "" {
+			return parsed.Hostname()
+		}
+	}
+	return ""
+}
+
+// clientVersion returns the module version this binary was built from.
+func clientVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return info.Main.Version
+}
+
+// envFallback sets the flag pointed by value from the named environment
+// variable, unless the flag was already set on the command line.
+func envFallback(value *string, name string) {
+	if *value == "" {
+		*value = os.Getenv(name)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *flagVersion {
+		fmt.Printf("%s\n", clientVersion())
+		os.Exit(0)
+	}
+	if err := setFormatter(*flagFormat, *flagGrouped); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setPrintOnly(*flagPrintOnly); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setUnits(*flagUnits); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setSyslog(*flagSyslog, *flagSyslogAddr); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setOutputs(*flagSamplesOut, *flagSummaryOut); err != nil {
+		errx(1, err, "main")
+	}
+	// Environment variables keep URLs (and their tokens) out of the
+	// process listing. Note that this must happen before locate.
+	envFallback(flagDownload, "NDT7_DOWNLOAD_URL")
+	envFallback(flagUpload, "NDT7_UPLOAD_URL")
+	envFallback(flagRoundTrip, "NDT7_ROUNDTRIP_URL")
+	if *flagPrintConfig {
+		if err := printConfig(); err != nil {
+			errx(1, err, "main")
+		}
+		os.Exit(0)
+	}
+	defer flushOutputs()
+	defer checkSubtestsRun() // when returning rather than exiting
+	defer exitOnLowResults() // likewise, for the modes returning early
+	ctx := withInterrupt(context.Background())
+	rand.Seed(time.Now().UnixNano())
+	if err := setupPayload(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setSession(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setClock(*flagClock); err != nil {
+		errx(1, err, "main")
+	}
+	if *flagRandomServer && *flagSelectByRTT {
+		errx(1, errors.New("-random-server conflicts with -select-by-rtt"), "main")
+	}
+	if err := checkUploadFixedSize(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := checkMinDuration(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := checkUploadRamp(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := checkConcurrency(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := checkLowThroughputFails(); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setBindAddr(*flagBind); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setResolver(*flagDNS); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setCongestion(*flagCongestion); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setSocketBuffers(*flagSoRcvBuf, *flagSoSndBuf); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setPin(*flagPinSHA256); err != nil {
+		errx(1, err, "main")
+	}
+	if err := setRequiredServerVersion(*flagRequireServerVersion); err != nil {
+		errx(1, err, "main")
+	}
+	warnNoVerify()
+	useLocate := locateNeeded()
+	var locateErr error // only non-nil with -suite-retries
+	if useLocate {
+		if locateErr = locate(ctx); locateErr != nil {
+			if *flagSuiteRetries < 1 {
+				locateFailed(locateErr)
+			}
+			warnx(locateErr, "locate")
+		} else if *flagSameServer || *flagRandomServer {
+			emit("Server", locatedMachine, "locate")
+		}
+	} else if *flagLocateMetadata {
+		// This is just metadata, hence failing is not fatal.
+		for _, URL := range []string{*flagDownload, *flagUpload, *flagRoundTrip} {
+			if URL != "" {
+				if err := locateMetadata(ctx, URL); err != nil {
+					warnx(err, "locate")
+				}
+				break
+			}
+		}
+	}
+	if *flagPrewarm {
+		defaultPrewarmer.Start(ctx, *flagDownload, *flagUpload)
+	}
+	if *flagServersFile != "" {
+		if err := testServersFile(ctx); err != nil {
+			errx(1, err, "main")
+		}
+		return
+	}
+	if *flagTestTopN > 0 {
+		if err := testTopN(ctx); err != nil {
+			locateFailed(err)
+		}
+		return
+	}
+	if *flagAlternate {
+		if err := alternate(ctx, useLocate); err != nil {
+			errx(1, err, "suite")
+		}
+		return
+	}
+	if *flagColdWarm {
+		if err := coldWarm(ctx, useLocate); err != nil {
 			errx(1, err, "download")
 		}
-		if err = downloadTest(ctx, conn); err != nil {
-			warnx(err, "download")
+		return
+	}
+	if *flagSmoke {
+		if err := smoke(ctx, useLocate); err != nil {
+			errx(exitSmokeFailed, err, "suite")
+		}
+		return
+	}
+	if *flagLatencyUnderLoad {
+		if err := latencyUnderLoad(ctx); err != nil {
+			errx(1, err, "roundtrip")
+		}
+		return
+	}
+	if *flagRepeat > 1 {
+		repeatSuite(ctx, useLocate)
+		return
+	}
+	retrySuite(ctx, useLocate, locateErr)
+	printVerdict()
+	exitOnLowResults()
+	if *flagQuietOnSuccess && failedExitCode != 0 {
+		exit(failedExitCode)
+	}
+}
+
+// runSuite runs the round-trip, download, and upload subtests, recording
+// their outcome into stats, and emits the report.
+func runSuite(ctx context.Context, useLocate bool, stats *repeatStats) {
+	var (
+		conn *websocket.Conn
+		err  error
+	)
+	rep := &report{
+		ClientVersion: clientVersion(),
+		StartTime:     time.Now().Format(time.RFC3339Nano),
+	}
+	pendingReport = rep
+	if *flagRoundTrip != "" {
+		emitBegin(*flagRoundTrip, roundTripRuntime, 0, roundTripMaxMessageSize, "roundtrip")
+		conn, err = connect(ctx, flagRoundTrip, useLocate, "roundtrip")
+		checkInterrupted()
+		stats.RoundTrip.Connect.record(err)
+		if err != nil {
+			connectFailed(err, "roundtrip")
+		} else {
+			summary, err := roundTripTest(ctx, testClock, conn)
+			closeConn(conn)
+			checkInterrupted()
+			rep.RoundTrip = &summary
+			stats.RoundTrip.Test.record(err)
+			if err != nil {
+				subtestFailed(exitRoundTripFailed, err, "roundtrip")
+			}
+			checkMaxRTT(summary)
+		}
+	}
+	var reusableConn *websocket.Conn
+	if *flagDownload != "" {
+		emitBegin(*flagDownload, *flagDuration, measureInterval, *flagMaxMessageSize, "download")
+		conn, err = connect(ctx, flagDownload, useLocate, "download")
+		checkInterrupted()
+		stats.Download.Connect.record(err)
+		if err != nil {
+			if !ndt5Fallback(ctx, err, *flagDownload, "download") {
+				connectFailed(err, "download")
+			}
+		} else {
+			var summary downloadSummary
+			summary, err = downloadTest(ctx, testClock, conn)
+			checkInterrupted()
+			rep.Download = &summary
+			stats.Download.Test.record(err)
+			if belowMinThroughput(summary.testResult, *flagMinDownloadMbit, "download") {
+				stats.Download.LowThroughput++
+			}
+			if err != nil {
+				if !ndt5Fallback(ctx, err, *flagDownload, "download") {
+					subtestFailed(exitDownloadFailed, err, "download")
+				}
+			} else if *flagReuseConn && summary.reusable && sameHost(*flagDownload, *flagUpload) {
+				reusableConn = conn
+			}
+			if conn != reusableConn {
+				closeConn(conn)
+			}
 		}
 	}
 	if *flagUpload != "" {
-		if conn, err = dialer(ctx, *flagUpload); err != nil {
-			errx(1, err, "upload")
+		emitBegin(*flagUpload, *flagDuration, measureInterval, uploadMaxMessageSize(), "upload")
+		if conn = reusableConn; conn == nil {
+			conn, err = connect(ctx, flagUpload, useLocate, "upload")
 		}
-		if err = uploadTest(ctx, conn); err != nil {
-			warnx(err, "upload")
+		checkInterrupted()
+		stats.Upload.Connect.record(err)
+		if err != nil {
+			if !ndt5Fallback(ctx, err, *flagUpload, "upload") {
+				connectFailed(err, "upload")
+			}
+		} else {
+			var summary uploadSummary
+			summary, err = uploadTest(ctx, testClock, conn)
+			closeConn(conn)
+			checkInterrupted()
+			rep.Upload = &summary
+			stats.Upload.Test.record(err)
+			if belowMinThroughput(summary.testResult, *flagMinUploadMbit, "upload") {
+				stats.Upload.LowThroughput++
+			}
+			if err != nil && !ndt5Fallback(ctx, err, *flagUpload, "upload") {
+				subtestFailed(exitUploadFailed, err, "upload")
+			}
 		}
 	}
+	rep.Server = reportServer()
+	rep.Location = serverLocation
+	rep.EndTime = time.Now().Format(time.RFC3339Nano)
+	if rep.Download != nil && rep.Upload != nil && rep.Upload.Throughput > 0 {
+		rep.AsymmetryRatio = rep.Download.Throughput / rep.Upload.Throughput
+	}
+	lastReport = rep
+	emit("Report", rep, "suite")
+	postReport()
 }
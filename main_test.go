@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// decodeEvents decodes the JSON events that emit wrote into output.
+func decodeEvents(t *testing.T, output *bytes.Buffer) []map[string]json.RawMessage {
+	var events []map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+	for {
+		var event map[string]json.RawMessage
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+}
+
+// appInfoTimes returns the ElapsedTime of the AppInfo events of testname.
+func appInfoTimes(t *testing.T, events []map[string]json.RawMessage, testname string) []int64 {
+	var out []int64
+	for _, event := range events {
+		data, found := event["AppInfo"]
+		if !found || string(event["Test"]) != `"`+testname+`"` {
+			continue
+		}
+		var info appInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, info.ElapsedTime)
+	}
+	return out
+}
+
+func equalInt64s(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Each read of a message takes 100 ms, hence the AppInfo events come after
+// the first read following each 250 ms tick and the read deadline expires
+// after ten messages, which is how the download normally ends.
+func TestDownloadIntervalsAndDeadline(t *testing.T) {
+	defer saveFlags()()
+	output, restore := captureEvents()
+	defer restore()
+	*flagDuration = time.Second
+	clk := newFakeClock()
+	conn, fake, done := dialFake(t, clk, func(conn *websocket.Conn) {
+		data := make([]byte, 1000)
+		for {
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+	})
+	defer done()
+	fake.readStep = 100 * time.Millisecond
+	summary, err := downloadTest(context.Background(), clk, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.ElapsedTime != 1000000 || summary.NumBytes != 10000 {
+		t.Fatalf("unexpected summary: %+v", summary.testResult)
+	}
+	got := appInfoTimes(t, decodeEvents(t, output), "download")
+	if expect := []int64{300000, 500000, 800000, 1000000}; !equalInt64s(got, expect) {
+		t.Fatalf("expected AppInfo at %v, got %v", expect, got)
+	}
+}
+
+// Each write takes 100 ms, hence the write deadline expires after ten
+// messages, which is how the upload normally ends.
+func TestUploadIntervalsAndDeadline(t *testing.T) {
+	defer saveFlags()()
+	output, restore := captureEvents()
+	defer restore()
+	*flagDuration = time.Second
+	clk := newFakeClock()
+	conn, fake, done := dialFake(t, clk, func(conn *websocket.Conn) {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	defer done()
+	fake.writeStep = 100 * time.Millisecond
+	summary, err := uploadTest(context.Background(), clk, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.ElapsedTime != 1000000 {
+		t.Fatalf("unexpected summary: %+v", summary.testResult)
+	}
+	got := appInfoTimes(t, decodeEvents(t, output), "upload")
+	if expect := []int64{300000, 500000, 800000, 1000000}; !equalInt64s(got, expect) {
+		t.Fatalf("expected AppInfo at %v, got %v", expect, got)
+	}
+}
+
+func TestDeadlineReached(t *testing.T) {
+	defer saveFlags()()
+	*flagDuration = time.Second
+	start := newFakeClock().Now()
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		err     error
+		expect  bool
+	}{
+		{"timeout after the runtime", time.Second, errFakeTimeout, true},
+		{"timeout before the runtime", 999 * time.Millisecond, errFakeTimeout, false},
+		{"other error after the runtime", time.Second, errors.New("mocked error"), false},
+		{"no error", time.Second, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := newFakeClock()
+			clk.Advance(tt.elapsed)
+			if got := deadlineReached(clk, tt.err, start); got != tt.expect {
+				t.Fatalf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+// With -sliding-deadline, the deadline only expires when the server stalls.
+func TestReadDeadlineReachedSliding(t *testing.T) {
+	defer saveFlags()()
+	*flagDuration = time.Second
+	maxBytes, sliding := *flagMaxBytes, *flagSlidingDeadline
+	defer func() { *flagMaxBytes, *flagSlidingDeadline = maxBytes, sliding }()
+	*flagMaxBytes, *flagSlidingDeadline = 1<<20, true
+	clk := newFakeClock()
+	start := clk.Now()
+	clk.Advance(2 * time.Second)
+	if readDeadlineReached(clk, errFakeTimeout, start) {
+		t.Fatal("expected the timeout to be a failure")
+	}
+}
+
+func TestPaceUploadSleepsUntilOnSchedule(t *testing.T) {
+	clk := newFakeClock()
+	start := clk.Now()
+	clk.Advance(250 * time.Millisecond)
+	paceUpload(clk, start, 1000000, 8e06) // 8 Mbit at 8 Mbit/s
+	if elapsed := since(clk, start); elapsed != time.Second {
+		t.Fatalf("expected to be on schedule after 1s, got %s", elapsed)
+	}
+	paceUpload(clk, start, 500000, 8e06) // ahead of schedule
+	if elapsed := since(clk, start); elapsed != time.Second {
+		t.Fatalf("expected not to sleep, got %s", elapsed)
+	}
+}
+
+func TestPayloadFileMessages(t *testing.T) {
+	saved := payloadFile
+	defer func() { payloadFile = saved }()
+	payloadFile = []byte("0123456789")
+	for _, tt := range []struct {
+		offset, n int
+		expect    string
+	}{
+		{0, 4, "0123"},
+		{8, 4, "8901"},
+		{3, 25, "3456789012345678901234567"},
+		{0, 10, "0123456789"},
+	} {
+		if got := string(fileChunk(tt.offset, tt.n)); got != tt.expect {
+			t.Errorf("fileChunk(%d, %d): expected %q, got %q", tt.offset, tt.n, tt.expect, got)
+		}
+	}
+	// With 4-byte messages, the offsets cycle over 0, 4, 8, 2, 6, hence
+	// the sixth message is the first one again, which we prepare once.
+	p := newPayload()
+	var messages []*websocket.PreparedMessage
+	for idx := 0; idx < 6; idx++ {
+		message, err := p.newMessage(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+	if messages[5] != messages[0] || messages[1] == messages[0] || len(p.cache) != 5 {
+		t.Fatalf("unexpected cache with %d messages", len(p.cache))
+	}
+	if _, err := p.newMessage(8); err != nil || len(p.cache) != 1 {
+		t.Fatal("expected a new cache for the new size")
+	}
+}
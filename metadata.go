@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// locateLocation is the location of a server according to locate.
+type locateLocation struct {
+	City    string `json:"city"`
+	Country string `json:"country"`
+}
+
+// serverLocation is the location of the server, with -locate-metadata, or
+// of the server selected by locate, if known.
+var serverLocation *locateLocation
+
+// locateMetadata queries locate, with -locate-metadata, to find the location
+// of the server of URL, which we got from the command line rather than from
+// locate. Since locate only returns nearby servers, it may not know it.
+func locateMetadata(ctx context.Context, URL string) error {
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return err
+	}
+	results, err := locateResults(ctx)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if locateResultMatches(result, parsed.Hostname()) {
+			serverLocation = result.Location
+			emit("ServerMetadata", struct {
+				Server   string
+				Location *locateLocation `json:",omitempty"`
+			}{locateResultServer(result), result.Location}, "locate")
+			return nil
+		}
+	}
+	return fmt.Errorf("locate does not know %s", parsed.Hostname())
+}
+
+// locateResultMatches returns whether host is the host of any URL of result
+// or, since the URLs may use another name, e.g. ndt-mlab1-mil04... for the
+// machine mlab1-mil04..., whether host ends with the machine name.
+func locateResultMatches(result locateResponseResult, host string) bool {
+	for _, URL := range result.URLs {
+		if parsed, err := url.Parse(URL); err == nil && parsed.Hostname() == host {
+			return true
+		}
+	}
+	return result.Machine != "" && strings.HasSuffix(host, result.Machine)
+}
@@ -0,0 +1,353 @@
+package main
+
+// This file implements a minimal ndt5 client that we only use as a fallback
+// when a server does not speak ndt7. It implements the plain TCP flavour of
+// the protocol using JSON messages and it only supports S2C and C2S.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ndt5 message types.
+const (
+	ndt5SrvQueue         = 1
+	ndt5MsgLogin         = 2
+	ndt5TestPrepare      = 3
+	ndt5TestStart        = 4
+	ndt5TestMsg          = 5
+	ndt5TestFinalize     = 6
+	ndt5MsgError         = 7
+	ndt5MsgResults       = 8
+	ndt5MsgLogout        = 9
+	ndt5MsgExtendedLogin = 11
+)
+
+// ndt5 test identifiers.
+const (
+	ndt5TestC2S    = 1 << 1
+	ndt5TestS2C    = 1 << 2
+	ndt5TestStatus = 1 << 4
+)
+
+const (
+	ndt5ControlPort = "3001"
+	ndt5Kickoff     = "123456 654321"
+	ndt5Runtime     = 10 * time.Second
+	ndt5Timeout     = 3 * ndt5Runtime // bounds the whole ndt5 session
+	ndt5Version     = "v3.7.0"
+)
+
+type ndt5Summary struct {
+	testResult
+	Protocol         string
+	ServerThroughput float64 `json:",omitempty"` // kbit/s
+}
+
+// errSubprotocolMismatch indicates the server did not select ndt7.
+var errSubprotocolMismatch = errors.New("unsupported subprotocol")
+
+// ndt5FallbackNeeded returns whether err indicates that the server does not
+// speak ndt7 and -allow-ndt5-fallback is set.
+func ndt5FallbackNeeded(err error) bool {
+	return *flagAllowNDT5Fallback && (errors.Is(err, websocket.ErrBadHandshake) ||
+		errors.Is(err, errSubprotocolMismatch))
+}
+
+// ndt5Fallback runs the ndt5 version of the download or upload subtest
+// against the host in URL, if the ndt7 error err warrants it. It returns
+// whether it handled err by running the ndt5 subtest.
+func ndt5Fallback(ctx context.Context, err error, URL string, testname string) bool {
+	if !ndt5FallbackNeeded(err) {
+		return false
+	}
+	warnx(err, testname)
+	emit("Protocol", "ndt5", testname)
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		suiteFailed = true
+		warnx(err, testname)
+		return true
+	}
+	testID := ndt5TestS2C
+	if testname == "upload" {
+		testID = ndt5TestC2S
+	}
+	if err := ndt5Run(ctx, parsed.Hostname(), testID, testname); err != nil {
+		suiteFailed = true
+		warnx(err, testname)
+	}
+	return true
+}
+
+// ndt5Conn is an ndt5 control connection.
+type ndt5Conn struct {
+	net.Conn
+}
+
+func (c ndt5Conn) writeMessage(kind byte, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0xffff {
+		return errors.New("ndt5: message too large")
+	}
+	header := []byte{kind, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(len(data)))
+	_, err = c.Write(append(header, data...))
+	return err
+}
+
+func (c ndt5Conn) readMessage() (byte, []byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(c, body); err != nil {
+		return 0, nil, err
+	}
+	if header[0] == ndt5MsgError {
+		return 0, nil, fmt.Errorf("ndt5: server error: %s", string(body))
+	}
+	return header[0], body, nil
+}
+
+// expectMessage reads a message of the given kind and returns the value of
+// its "msg" field.
+func (c ndt5Conn) expectMessage(kind byte) (string, error) {
+	got, body, err := c.readMessage()
+	if err != nil {
+		return "", err
+	}
+	if got != kind {
+		return "", fmt.Errorf("ndt5: expected message %d, got %d", kind, got)
+	}
+	var message struct {
+		Msg string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return "", err
+	}
+	return message.Msg, nil
+}
+
+func ndt5Run(ctx context.Context, host string, testID int, testname string) error {
+	ctx, cancel := context.WithTimeout(ctx, ndt5Timeout)
+	defer cancel()
+	dialer := newNetDialer()
+	raw, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, ndt5ControlPort))
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	deadline, _ := ctx.Deadline()
+	if err := raw.SetDeadline(deadline); err != nil {
+		return err
+	}
+	conn := ndt5Conn{raw}
+	if err := conn.writeMessage(ndt5MsgExtendedLogin, map[string]string{
+		"msg":   ndt5Version,
+		"tests": strconv.Itoa(testID | ndt5TestStatus),
+	}); err != nil {
+		return err
+	}
+	kickoff := make([]byte, len(ndt5Kickoff))
+	if _, err := io.ReadFull(conn, kickoff); err != nil {
+		return err
+	}
+	if string(kickoff) != ndt5Kickoff {
+		return errors.New("ndt5: invalid kickoff message")
+	}
+	queue, err := conn.expectMessage(ndt5SrvQueue)
+	if err != nil {
+		return err
+	}
+	if queue != "0" {
+		return fmt.Errorf("ndt5: server is busy (queue: %s)", queue)
+	}
+	if _, err := conn.expectMessage(ndt5MsgLogin); err != nil { // version
+		return err
+	}
+	tests, err := conn.expectMessage(ndt5MsgLogin)
+	if err != nil {
+		return err
+	}
+	for _, field := range strings.Fields(tests) {
+		switch field {
+		case strconv.Itoa(ndt5TestS2C):
+			err = ndt5Download(ctx, conn, host, testname)
+		case strconv.Itoa(ndt5TestC2S):
+			err = ndt5Upload(ctx, conn, host, testname)
+		default:
+			continue // we did not ask for it, so there's nothing to run
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		kind, _, err := conn.readMessage()
+		if err != nil {
+			return err
+		}
+		if kind == ndt5MsgLogout {
+			return nil
+		}
+		// Just ignore MsgResults, we already have our numbers.
+	}
+}
+
+// ndt5Prepare handles TestPrepare and TestStart and returns the connection
+// on which to measure.
+func ndt5Prepare(ctx context.Context, conn ndt5Conn, host string) (net.Conn, error) {
+	prepare, err := conn.expectMessage(ndt5TestPrepare)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(prepare)
+	if len(fields) < 1 {
+		return nil, errors.New("ndt5: missing test port")
+	}
+	dialer := newNetDialer()
+	measurement, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, fields[0]))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.expectMessage(ndt5TestStart); err != nil {
+		measurement.Close()
+		return nil, err
+	}
+	return measurement, nil
+}
+
+func ndt5Download(ctx context.Context, conn ndt5Conn, host, testname string) error {
+	measurement, err := ndt5Prepare(ctx, conn, host)
+	if err != nil {
+		return err
+	}
+	defer measurement.Close()
+	var total int64
+	start := testClock.Now()
+	if err := measurement.SetReadDeadline(start.Add(ndt5Runtime * 3 / 2)); err != nil {
+		return err
+	}
+	ticker := testClock.NewTicker(measureInterval)
+	defer ticker.Stop()
+	buffer := make([]byte, 1<<17)
+	for {
+		n, err := measurement.Read(buffer)
+		total += int64(n)
+		if errors.Is(err, io.EOF) {
+			break // the server closes the connection when done
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ticker.Chan():
+			emitAppInfo(testClock, start, total, testname)
+		default:
+			// NOTHING
+		}
+	}
+	elapsed := since(testClock, start)
+	kind, body, err := conn.readMessage()
+	if err != nil {
+		return err
+	}
+	if kind != ndt5TestMsg {
+		return fmt.Errorf("ndt5: expected message %d, got %d", ndt5TestMsg, kind)
+	}
+	var server struct {
+		ThroughputValue string
+	}
+	if err := json.Unmarshal(body, &server); err != nil {
+		return err
+	}
+	serverThroughput, _ := strconv.ParseFloat(server.ThroughputValue, 64)
+	clientThroughput := float64(total*8) / elapsed.Seconds() / 1e03
+	if err := conn.writeMessage(ndt5TestMsg, map[string]string{
+		"msg": strconv.FormatFloat(clientThroughput, 'f', -1, 64),
+	}); err != nil {
+		return err
+	}
+	emitSummary(ndt5Summary{
+		testResult:       newTestResult(elapsed, total),
+		Protocol:         "ndt5",
+		ServerThroughput: serverThroughput,
+	}, testname)
+	return ndt5Finalize(conn)
+}
+
+func ndt5Upload(ctx context.Context, conn ndt5Conn, host, testname string) error {
+	measurement, err := ndt5Prepare(ctx, conn, host)
+	if err != nil {
+		return err
+	}
+	var total int64
+	start := testClock.Now()
+	if err := measurement.SetWriteDeadline(start.Add(ndt5Runtime)); err != nil {
+		measurement.Close()
+		return err
+	}
+	ticker := testClock.NewTicker(measureInterval)
+	defer ticker.Stop()
+	buffer := make([]byte, 1<<13)
+	for since(testClock, start) < ndt5Runtime {
+		n, err := measurement.Write(buffer)
+		total += int64(n)
+		if err != nil {
+			break // likely the deadline, otherwise the server will tell us
+		}
+		select {
+		case <-ticker.Chan():
+			emitAppInfo(testClock, start, total, testname)
+		default:
+			// NOTHING
+		}
+	}
+	elapsed := since(testClock, start)
+	measurement.Close()
+	throughput, err := conn.expectMessage(ndt5TestMsg)
+	if err != nil {
+		return err
+	}
+	serverThroughput, _ := strconv.ParseFloat(throughput, 64)
+	emitSummary(ndt5Summary{
+		testResult:       newTestResult(elapsed, total),
+		Protocol:         "ndt5",
+		ServerThroughput: serverThroughput,
+	}, testname)
+	return ndt5Finalize(conn)
+}
+
+// ndt5Finalize skips the remaining TestMsg messages until TestFinalize.
+func ndt5Finalize(conn ndt5Conn) error {
+	for {
+		kind, _, err := conn.readMessage()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case ndt5TestFinalize:
+			return nil
+		case ndt5TestMsg:
+			// NOTHING
+		default:
+			return fmt.Errorf("ndt5: unexpected message %d", kind)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// bindAddr is the local address from -bind, or nil.
+var bindAddr *net.TCPAddr
+
+// errBindPort indicates that the -bind address has a non-zero port.
+var errBindPort = errors.New("-bind must not have a port")
+
+// setBindAddr parses the -bind address, which is either an IP address or an
+// address and port, e.g. 192.0.2.1, fe80::1%eth0, or [fe80::1%eth0]:0. A
+// scoped IPv6 address keeps its zone so we can test link-local servers. We
+// reject a non-zero port, since all the connections would bind it and only
+// the first one could succeed.
+func setBindAddr(address string) error {
+	if address == "" {
+		bindAddr = nil
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "0")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return err
+	}
+	if addr.Port != 0 {
+		return errBindPort
+	}
+	bindAddr = addr
+	return nil
+}
+
+// newNetDialer returns the net.Dialer to use for all connections. Note that
+// net.Dialer already understands zoned addresses like [fe80::1%eth0]:443,
+// which is what we get from URLs like ws://[fe80::1%25eth0]:443/.
+func newNetDialer() *net.Dialer {
+	dialer := &net.Dialer{Resolver: resolver}
+	if bindAddr != nil {
+		dialer.LocalAddr = bindAddr
+	}
+	if len(socketOptions) > 0 {
+		dialer.Control = controlSocket
+	}
+	return dialer
+}
+
+// socketOptions set options of the sockets before connecting.
+var socketOptions []func(fd uintptr) error
+
+// socketBuffers are the buffer sizes applied with -so-rcvbuf and -so-sndbuf.
+type socketBuffers struct {
+	RcvBuf int `json:",omitempty"`
+	SndBuf int `json:",omitempty"`
+}
+
+// appliedBuffers contains the sizes applied by the kernel. See sockbuf_unix.go.
+var appliedBuffers socketBuffers
+
+// controlSocket is a net.Dialer Control applying socketOptions.
+func controlSocket(network, address string, conn syscall.RawConn) error {
+	var err error
+	cerr := conn.Control(func(fd uintptr) {
+		for _, option := range socketOptions {
+			if err = option(fd); err != nil {
+				return
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// resolver is the resolver of all connections, which uses -dns, if set.
+var resolver = net.DefaultResolver
+
+// setResolver configures the resolver to use the DNS server at address,
+// e.g. 192.0.2.53 or [2001:db8::53]:5353, unless address is empty. We
+// connect to the DNS server from the -bind address, if any.
+func setResolver(address string) error {
+	if address == "" {
+		resolver = net.DefaultResolver
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "53")
+	}
+	if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+		return err
+	}
+	resolver = &net.Resolver{
+		PreferGo: true, // otherwise we may not use Dial
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{}
+			if bindAddr != nil && (network == "udp" || network == "udp4" || network == "udp6") {
+				dialer.LocalAddr = &net.UDPAddr{IP: bindAddr.IP, Zone: bindAddr.Zone}
+			} else if bindAddr != nil {
+				dialer.LocalAddr = &net.TCPAddr{IP: bindAddr.IP, Zone: bindAddr.Zone}
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	return nil
+}
+
+// newHTTPTransport returns the http.Transport to use for plain HTTP requests
+// such as locate, which dials like the websocket dialer, such that, e.g.,
+// locate sees the network that we are going to test with -bind.
+func newHTTPTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newNetDialer().DialContext
+	return transport
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetBindAddr(t *testing.T) {
+	defer setBindAddr("")
+	tests := []struct {
+		address string
+		expect  *net.TCPAddr // nil when we expect an error
+	}{
+		{"fe80::1%eth0", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}},
+		{"[fe80::1%eth0]:0", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}},
+		{"[fe80::1%eth0]", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}},
+		{"192.0.2.1", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}},
+		{"192.0.2.1:0", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}},
+		{"192.0.2.1:5555", nil},
+		{"192.0.2.1:foo", nil},
+		{"192.0.2.1:70000", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := setBindAddr(tt.address)
+			if tt.expect == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", bindAddr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bindAddr.IP.Equal(tt.expect.IP) || bindAddr.Port != tt.expect.Port ||
+				bindAddr.Zone != tt.expect.Zone {
+				t.Fatalf("expected %s, got %s", tt.expect, bindAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// formatter converts an event into the bytes to write on the standard
+// output. It returns nil bytes when the event should not be written.
+type formatter interface {
+	Format(name string, value interface{}, testname string) ([]byte, error)
+}
+
+// finalFormatter is a formatter that may write a last line when we exit.
+type finalFormatter interface {
+	Final(exitcode int, rep *report) []byte
+}
+
+// serverMeasurement is a measurement sent by the server, which we pass
+// through as it was received.
+type serverMeasurement []byte
+
+// appInfo is the event emitted periodically by download and upload.
+type appInfo struct {
+	NumBytes    int64
+	ElapsedTime int64
+	Progress    float64 `json:",omitempty"` // percentage, with -progress
+	// ServerThroughput is the upload throughput according to the last
+	// server measurement (bit/s), which is lower than our throughput when
+	// the data is still in the buffers or the server throttles us.
+	ServerThroughput float64 `json:",omitempty"`
+}
+
+// jsonFormatter emits each event as a JSON object followed by an empty line.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(name string, value interface{}, testname string) ([]byte, error) {
+	return formatJSON(name, value, testname, true)
+}
+
+// groupedFormatter implements -grouped. It is like jsonFormatter, except
+// that it omits the Test field and, instead, emits a header like
+// {"Test":"download","Start":"..."} when the test changes.
+type groupedFormatter struct {
+	testname string
+}
+
+func (f *groupedFormatter) Format(name string, value interface{}, testname string) ([]byte, error) {
+	data, err := formatJSON(name, value, testname, false)
+	if err != nil || testname == f.testname {
+		return data, err
+	}
+	f.testname = testname
+	header, err := marshalJSON(struct {
+		Test  string
+		Start string // RFC3339
+	}{testname, time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		return nil, err
+	}
+	return append(append(header, "\n\n"...), data...), nil
+}
+
+// formatJSON formats an event as a JSON object, including the Test field
+// when withTest is true.
+func formatJSON(name string, value interface{}, testname string, withTest bool) ([]byte, error) {
+	if measurement, ok := value.(serverMeasurement); ok {
+		return append(append([]byte{}, measurement...), '\n'), nil
+	}
+	data, err := marshalJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	if result, ok := value.(summaryResult); ok && defaultUnit != nil {
+		if data, err = appendUnitField(data, result); err != nil {
+			return nil, err
+		}
+	}
+	if nested := nestedSummaries(value); len(nested) > 0 && defaultUnit != nil {
+		if data, err = annotateNestedSummaries(data, nested); err != nil {
+			return nil, err
+		}
+	}
+	event := fmt.Sprintf(`{"%s":%s`, name, data)
+	if withTest {
+		test, err := marshalJSON(testname)
+		if err != nil {
+			return nil, err
+		}
+		event += `,"Test":` + string(test)
+	}
+	if len(flagTags) > 0 {
+		tagsData, err := marshalJSON(flagTags)
+		if err != nil {
+			return nil, err
+		}
+		event += `,"Tags":` + string(tagsData)
+	}
+	if *flagCorrelationID != "" {
+		idData, err := marshalJSON(*flagCorrelationID)
+		if err != nil {
+			return nil, err
+		}
+		event += `,"CorrelationID":` + string(idData)
+	}
+	if sessionID != "" {
+		event += fmt.Sprintf(`,"SessionID":"%s","Iteration":%d`, sessionID, iteration)
+	}
+	return []byte(event + "}\n\n"), nil
+}
+
+// marshalJSON is like json.Marshal except that it does not escape HTML
+// characters, which would make addresses and URLs harder to read.
+func marshalJSON(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// appendJSONField adds a field to the JSON object in data.
+func appendJSONField(data []byte, name string, value interface{}) ([]byte, error) {
+	field, err := marshalJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(data, []byte("}")) {
+		return nil, errors.New("cannot add a field to a non-object")
+	}
+	if len(data) > 2 {
+		data = append(data[:len(data)-1], ',')
+	} else {
+		data = data[:len(data)-1]
+	}
+	return append(append(data, fmt.Sprintf("%q:", name)...), append(field, '}')...), nil
+}
+
+// summaryResult is a summary containing the result of a subtest.
+type summaryResult interface {
+	result() testResult
+}
+
+// appendUnitField adds to data, which is the JSON of summary, the field
+// with the throughput in defaultUnit.
+func appendUnitField(data []byte, summary summaryResult) ([]byte, error) {
+	return appendJSONField(data, "Throughput"+defaultUnit.Name,
+		summary.result().Throughput/defaultUnit.Scale)
+}
+
+// nestedSummaries returns the summaries contained in value, in the order
+// in which they appear in its JSON, e.g., the download and the upload of
+// the report.
+func nestedSummaries(value interface{}) []summaryResult {
+	var out []summaryResult
+	add := func(download *downloadSummary, upload *uploadSummary) {
+		if download != nil {
+			out = append(out, download)
+		}
+		if upload != nil {
+			out = append(out, upload)
+		}
+	}
+	switch v := value.(type) {
+	case *report:
+		add(v.Download, v.Upload)
+	case report:
+		add(v.Download, v.Upload)
+	case coldWarmResult:
+		add(v.Cold, nil)
+		add(v.Warm, nil)
+	case []serverResult:
+		for _, result := range v {
+			add(result.Download, result.Upload)
+		}
+	}
+	return out
+}
+
+// annotateNestedSummaries adds the field with the throughput in defaultUnit
+// to each of the nested summaries within data. Since marshalJSON is
+// deterministic, each summary appears in data as marshalJSON returns it.
+func annotateNestedSummaries(data []byte, nested []summaryResult) ([]byte, error) {
+	var out []byte
+	for _, summary := range nested {
+		plain, err := marshalJSON(summary)
+		if err != nil {
+			return nil, err
+		}
+		idx := bytes.Index(data, plain)
+		if idx < 0 {
+			return nil, errors.New("cannot find a nested summary")
+		}
+		annotated, err := appendUnitField(plain, summary)
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, data[:idx]...), annotated...)
+		data = data[idx+len(plain):]
+	}
+	return append(out, data...), nil
+}
+
+// unit is a unit in which to express the throughput.
+type unit struct {
+	Name  string  // suffix of the summary field name
+	Scale float64 // bit/s per unit
+}
+
+var units = map[string]*unit{
+	"mbit":  {Name: "Mbit", Scale: 1e06},
+	"mbyte": {Name: "MByte", Scale: 8e06},
+	"gbit":  {Name: "Gbit", Scale: 1e09},
+}
+
+// defaultUnit is the unit of the additional throughput field of the
+// summaries, or nil when we only emit the throughput in bit/s.
+var defaultUnit *unit
+
+// setUnits selects the unit of the additional throughput field given its
+// name. The empty name means no additional field.
+func setUnits(name string) error {
+	if name == "" {
+		defaultUnit = nil
+		return nil
+	}
+	u, found := units[name]
+	if !found {
+		return errors.New("unknown throughput units")
+	}
+	defaultUnit = u
+	return nil
+}
+
+// influxFormatter emits the summaries using the InfluxDB line protocol. It
+// remembers the server from the begin event and the min RTT from the server
+// measurements, such that it can use them when formatting the summary.
+type influxFormatter struct {
+	minRTT map[string]int64
+	server map[string]string
+}
+
+func newInfluxFormatter() *influxFormatter {
+	return &influxFormatter{
+		minRTT: make(map[string]int64),
+		server: make(map[string]string),
+	}
+}
+
+func (f *influxFormatter) Format(name string, value interface{}, testname string) ([]byte, error) {
+	switch v := value.(type) {
+	case beginEvent:
+		if parsed, err := url.Parse(v.URL); err == nil {
+			f.server[testname] = parsed.Hostname()
+		}
+	case serverMeasurement:
+		var m measurement
+		if err := json.Unmarshal(v, &m); err == nil && m.TCPInfo != nil {
+			f.minRTT[testname] = m.TCPInfo.MinRTT
+		}
+	case downloadSummary:
+		return f.line(testname, v.NumBytes, v.ElapsedTime), nil
+	case uploadSummary:
+		return f.line(testname, v.NumBytes, v.ElapsedTime), nil
+	case roundTripAppInfo:
+		return []byte(fmt.Sprintf("ndt7,test=%s,server=%s%s srtt_us=%f,rttvar_us=%f %d\n",
+			influxEscape(testname), influxEscape(f.serverOf(testname)), influxTags(),
+			v.SRTT, v.RTTVar, time.Now().UnixNano())), nil
+	}
+	return nil, nil
+}
+
+func (f *influxFormatter) serverOf(testname string) string {
+	if server := f.server[testname]; server != "" {
+		return server
+	}
+	return "unknown" // tags cannot have empty values
+}
+
+func (f *influxFormatter) line(testname string, numBytes, elapsed int64) []byte {
+	var mbit float64
+	if elapsed > 0 {
+		mbit = float64(numBytes*8) / float64(elapsed) // bit/μs is Mbit/s
+	}
+	fields := fmt.Sprintf("mbit=%f,bytes=%di,elapsed_us=%di", mbit, numBytes, elapsed)
+	if minRTT, found := f.minRTT[testname]; found {
+		fields += fmt.Sprintf(",min_rtt_us=%di", minRTT)
+	}
+	return []byte(fmt.Sprintf("ndt7,test=%s,server=%s%s %s %d\n", influxEscape(testname),
+		influxEscape(f.serverOf(testname)), influxTags(), fields, time.Now().UnixNano()))
+}
+
+// influxTags returns the -tag pairs as additional tags, sorted by key as
+// recommended by the InfluxDB documentation, followed by -correlation-id
+// and, with -repeat, by the session ID and the iteration.
+func influxTags() string {
+	var keys []string
+	for key := range flagTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var out string
+	for _, key := range keys {
+		out += "," + influxEscape(key) + "=" + influxEscape(flagTags[key])
+	}
+	if *flagCorrelationID != "" {
+		out += ",correlation_id=" + influxEscape(*flagCorrelationID)
+	}
+	if sessionID != "" {
+		out += fmt.Sprintf(",session_id=%s,iteration=%d", sessionID, iteration)
+	}
+	return out
+}
+
+// influxEscape escapes a tag value for the InfluxDB line protocol.
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+var defaultFormatter formatter = jsonFormatter{}
+
+// setFormatter selects the formatter to use given its name, and whether to
+// group the JSON events by test.
+func setFormatter(name string, grouped bool) error {
+	if grouped && name != "json" {
+		return errors.New("-grouped requires -format json")
+	}
+	switch name {
+	case "json":
+		defaultFormatter = jsonFormatter{}
+		if grouped {
+			defaultFormatter = &groupedFormatter{}
+		}
+	case "influx":
+		defaultFormatter = newInfluxFormatter()
+	case "logline":
+		defaultFormatter = &loglineFormatter{}
+	case "protobuf":
+		defaultFormatter = protobufFormatter{}
+	default:
+		return errors.New("unknown output format")
+	}
+	return nil
+}
+
+// stdout buffers the standard output, which we flush after each event
+// unless -line-buffered is false.
+var stdout = bufio.NewWriter(os.Stdout)
+
+// The writers for the per-interval samples, for the summaries, and for all
+// the other events. They all default to the standard output.
+var (
+	samplesWriter io.Writer = stdout
+	summaryWriter io.Writer = stdout
+	eventsWriter  io.Writer = stdout
+)
+
+// flushOutputs flushes the buffered writers.
+func flushOutputs() {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	flushOutputsLocked()
+}
+
+func flushOutputsLocked() {
+	for _, w := range []io.Writer{samplesWriter, summaryWriter, eventsWriter} {
+		if buffered, ok := w.(*bufio.Writer); ok {
+			buffered.Flush()
+		}
+	}
+}
+
+// setOutputs configures the samples and summary writers to write into the
+// given files, unless the corresponding file name is empty.
+func setOutputs(samplesPath, summaryPath string) error {
+	if samplesPath != "" {
+		fp, err := os.Create(samplesPath)
+		if err != nil {
+			return err
+		}
+		samplesWriter = bufio.NewWriter(fp)
+	}
+	if summaryPath != "" {
+		fp, err := os.Create(summaryPath)
+		if err != nil {
+			return err
+		}
+		summaryWriter = bufio.NewWriter(fp)
+	}
+	return nil
+}
+
+// writerFor returns the writer for the event with the given value.
+func writerFor(name string, value interface{}) io.Writer {
+	switch value.(type) {
+	case appInfo, roundTripAppInfo, serverMeasurement, readEvent, rttStats, byteSample:
+		return samplesWriter
+	}
+	if name == "Summary" || name == "Report" || name == "RepeatStats" {
+		return summaryWriter
+	}
+	return eventsWriter
+}
+
+// emitMu serializes emit, since formatters may have state and subtests
+// may run concurrently.
+var emitMu sync.Mutex
+
+// problemEvents are the events emitted with -quiet-on-success.
+var problemEvents = map[string]bool{
+	"Abort":   true,
+	"Failure": true,
+	"Warning": true,
+}
+
+// emit formats an event using the configured formatter and writes it.
+func emit(name string, value interface{}, testname string) {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	if name == "Failure" {
+		failureCount++
+	}
+	if *flagQuietOnSuccess && !problemEvents[name] {
+		return
+	}
+	data, err := defaultFormatter.Format(name, value, testname)
+	if err != nil {
+		// Avoid recursion by using the JSON formatter for the failure.
+		name, value = "Failure", newFailureEvent(err)
+		data, _ = jsonFormatter{}.Format(name, value, testname)
+	}
+	if validateEvent != nil && data != nil {
+		validateEvent(name, value, data)
+	}
+	if syslogEvent != nil {
+		if data != nil {
+			syslogEvent(name, data)
+		}
+		return
+	}
+	writerFor(name, value).Write(data)
+	if *flagLineBuffered {
+		flushOutputsLocked()
+	}
+}
+
+// emitFinal writes the last line of the formatter, if any, when exiting
+// with exitcode. Like the report, it goes to the summary writer.
+func emitFinal(exitcode int) {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	final, ok := defaultFormatter.(finalFormatter)
+	if !ok {
+		return
+	}
+	data := final.Final(exitcode, pendingReport)
+	if data == nil {
+		return
+	}
+	if syslogEvent != nil {
+		syslogEvent("Report", data)
+		return
+	}
+	summaryWriter.Write(data)
+}
+
+// failureCount is the number of Failure events emitted so far.
+var failureCount int
+
+// validateEvent, when not nil, checks the formatted event. See validate.go.
+var validateEvent func(name string, value interface{}, data []byte)
+
+// syslogEvent, when not nil, writes the formatted event to syslog rather
+// than to the writers. See syslog.go.
+var syslogEvent func(name string, data []byte)
+
+func emitSummary(summary interface{}, testname string) {
+	emit("Summary", summary, testname)
+}
+
+// emitAppInfo emits and returns the current sample.
+func emitAppInfo(clk clock, start time.Time, total int64, testname string) appInfo {
+	info := newAppInfo(clk, start, total)
+	emit("AppInfo", info, testname)
+	return info
+}
+
+// newAppInfo returns the current sample.
+func newAppInfo(clk clock, start time.Time, total int64) appInfo {
+	elapsed := since(clk, start)
+	info := appInfo{
+		NumBytes:    total,
+		ElapsedTime: int64(elapsed / time.Microsecond),
+	}
+	if *flagProgress {
+		info.Progress = progress(elapsed, total)
+	}
+	return info
+}
+
+// progress returns the percentage of the download or upload completed so
+// far, which depends on bytes rather than on time in byte-limited mode.
+func progress(elapsed time.Duration, total int64) float64 {
+	var fraction float64
+	if *flagMaxBytes > 0 {
+		fraction = float64(total) / float64(*flagMaxBytes)
+	} else if *flagDuration > 0 {
+		fraction = float64(elapsed) / float64(*flagDuration)
+	}
+	return math.Min(fraction, 1) * 100
+}
+
+// failureEvent describes an error.
+type failureEvent struct {
+	Error       string
+	ElapsedTime int64  `json:",omitempty"` // since the subtest began (μs)
+	Time        string // when the error occurred (RFC3339)
+	CloseCode   int    `json:",omitempty"` // when the server closed
+	CloseReason string `json:",omitempty"`
+}
+
+func newFailureEvent(err error) failureEvent {
+	event := failureEvent{
+		Error: redactError(err),
+		Time:  time.Now().Format(time.RFC3339Nano),
+	}
+	var subtestErr *subtestError
+	if errors.As(err, &subtestErr) {
+		event.ElapsedTime = int64(subtestErr.elapsed / time.Microsecond)
+		event.Time = subtestErr.time.Format(time.RFC3339Nano)
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		event.CloseCode = closeErr.Code
+		event.CloseReason = closeErr.Text
+	}
+	return event
+}
+
+func warnx(err error, testname string) {
+	checkInterrupted()
+	emit("Failure", newFailureEvent(err), testname)
+}
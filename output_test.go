@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnitsAnnotateNestedSummaries(t *testing.T) {
+	saved := defaultUnit
+	defer func() { defaultUnit = saved }()
+	if err := setUnits("mbit"); err != nil {
+		t.Fatal(err)
+	}
+	download := downloadSummary{testResult: testResult{Throughput: 94.2e06}}
+	upload := uploadSummary{testResult: testResult{Throughput: 11.3e06}}
+	data, err := formatJSON("Report", &report{Download: &download, Upload: &upload}, "suite", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Report struct {
+			Download, Upload struct {
+				Throughput, ThroughputMbit float64
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Report.Download.ThroughputMbit != 94.2 || event.Report.Upload.ThroughputMbit != 11.3 {
+		t.Fatalf("unexpected report: %s", data)
+	}
+	if event.Report.Download.Throughput != 94.2e06 {
+		t.Fatalf("the throughput in bit/s changed: %s", data)
+	}
+}
+
+// Identical summaries must each be annotated once.
+func TestUnitsAnnotateIdenticalSummaries(t *testing.T) {
+	saved := defaultUnit
+	defer func() { defaultUnit = saved }()
+	if err := setUnits("gbit"); err != nil {
+		t.Fatal(err)
+	}
+	download := downloadSummary{testResult: testResult{Throughput: 1e09}}
+	data, err := formatJSON("ColdWarm", coldWarmResult{Cold: &download, Warm: &download}, "download", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		ColdWarm struct {
+			Cold, Warm map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if event.ColdWarm.Cold["ThroughputGbit"] != 1.0 || event.ColdWarm.Warm["ThroughputGbit"] != 1.0 {
+		t.Fatalf("unexpected event: %s", data)
+	}
+}
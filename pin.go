@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+// errPinMismatch indicates that the certificate does not match -pin-sha256.
+var errPinMismatch = errors.New("the certificate does not match -pin-sha256")
+
+// pinnedSHA256 is the decoded -pin-sha256, or nil.
+var pinnedSHA256 []byte
+
+// setPin parses the base64 SHA-256 of -pin-sha256.
+func setPin(pin string) error {
+	if pin == "" {
+		pinnedSHA256 = nil
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return err
+	}
+	if len(data) != sha256.Size {
+		return errors.New("-pin-sha256 is not a SHA-256 hash")
+	}
+	pinnedSHA256 = data
+	return nil
+}
+
+// verifyPin is a tls.Config VerifyPeerCertificate that accepts the peer
+// when the SHA-256 of the SubjectPublicKeyInfo or of the whole certificate
+// of its leaf certificate matches -pin-sha256. Since we do not verify the
+// chain, we must not consider the other certificates, which anyone could
+// append to the chain of a forged leaf certificate.
+func verifyPin(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) < 1 {
+		return errPinMismatch
+	}
+	certSum := sha256.Sum256(rawCerts[0])
+	if bytes.Equal(certSum[:], pinnedSHA256) {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if bytes.Equal(spkiSum[:], pinnedSHA256) {
+		return nil
+	}
+	return errPinMismatch
+}
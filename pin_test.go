@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed DER certificate for name.
+func newTestCert(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestVerifyPin(t *testing.T) {
+	saved := pinnedSHA256
+	defer func() { pinnedSHA256 = saved }()
+	pinned := newTestCert(t, "ndt.example.com")
+	forged := newTestCert(t, "ndt.example.com")
+	parsed, err := x509.ParseCertificate(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSum := sha256.Sum256(pinned)
+	spkiSum := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+	tests := []struct {
+		name     string
+		pin      []byte
+		rawCerts [][]byte
+		expect   error
+	}{
+		{"certificate", certSum[:], [][]byte{pinned}, nil},
+		{"public key", spkiSum[:], [][]byte{pinned}, nil},
+		{"pinned leaf with a chain", spkiSum[:], [][]byte{pinned, forged}, nil},
+		{"other certificate", certSum[:], [][]byte{forged}, errPinMismatch},
+		{"forged leaf with the pinned certificate", certSum[:], [][]byte{forged, pinned}, errPinMismatch},
+		{"forged leaf with the pinned key", spkiSum[:], [][]byte{forged, pinned}, errPinMismatch},
+		{"no certificates", certSum[:], nil, errPinMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := setPin(base64.StdEncoding.EncodeToString(tt.pin)); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyPin(tt.rawCerts, nil); err != tt.expect {
+				t.Fatalf("expected %v, got %v", tt.expect, err)
+			}
+		})
+	}
+}
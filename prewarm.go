@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// prewarmEntry is the result of resolving a host in the background.
+type prewarmEntry struct {
+	done  chan struct{} // closed when addrs and err are available
+	addrs []string
+	err   error
+}
+
+// prewarmer resolves the hosts of the URLs we will use while other subtests
+// are running, so that connecting to them later does not need to wait for
+// the DNS. Go does not cache DNS results, so we keep them ourselves.
+type prewarmer struct {
+	mu      sync.Mutex
+	entries map[string]*prewarmEntry
+}
+
+var defaultPrewarmer = &prewarmer{entries: make(map[string]*prewarmEntry)}
+
+// Start starts resolving the host of each URL in the background.
+func (p *prewarmer) Start(ctx context.Context, URLs ...string) {
+	for _, URL := range URLs {
+		parsed, err := url.Parse(URL)
+		if err != nil || parsed.Hostname() == "" {
+			continue // dialing will fail later with a better error
+		}
+		host := parsed.Hostname()
+		p.mu.Lock()
+		if _, found := p.entries[host]; !found {
+			entry := &prewarmEntry{done: make(chan struct{})}
+			p.entries[host] = entry
+			go func() {
+				entry.addrs, entry.err = resolver.LookupHost(ctx, host)
+				close(entry.done)
+			}()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// DialContext is like net.Dialer.DialContext except that it uses the
+// addresses resolved in the background, if any, waiting for a pending
+// resolution rather than starting another one.
+func (p *prewarmer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := newNetDialer()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	entry := p.entries[host]
+	p.mu.Unlock()
+	if entry == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if entry.err != nil || len(entry.addrs) < 1 {
+		return dialer.DialContext(ctx, network, address)
+	}
+	for _, addr := range entry.addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// printOnlyFormatter implements -print-only. It only writes the requested
+// value, when the report is available, and the problems, which we write on
+// the standard error such that the standard output only contains the value.
+type printOnlyFormatter struct {
+	key    string
+	minRTT int64 // minimum of the server measured min RTT (μs)
+}
+
+// printOnlyKeys are the values that -print-only can print.
+var printOnlyKeys = map[string]bool{
+	"download-mbit": true,
+	"upload-mbit":   true,
+	"min-rtt-ms":    true,
+}
+
+// setPrintOnly configures the output for -print-only, unless key is empty.
+func setPrintOnly(key string) error {
+	if key == "" {
+		return nil
+	}
+	if !printOnlyKeys[key] {
+		return errors.New("-print-only must be download-mbit, upload-mbit, or min-rtt-ms")
+	}
+	defaultFormatter = &printOnlyFormatter{key: key}
+	eventsWriter = os.Stderr
+	return nil
+}
+
+func (f *printOnlyFormatter) Format(name string, value interface{}, testname string) ([]byte, error) {
+	switch v := value.(type) {
+	case serverMeasurement:
+		f.minRTT = serverMinRTT(v, f.minRTT)
+		return nil, nil
+	case *report:
+		return f.value(v), nil
+	}
+	if problemEvents[name] {
+		return jsonFormatter{}.Format(name, value, testname)
+	}
+	return nil, nil
+}
+
+// serverMinRTT returns the minimum between current, unless zero, and the
+// min RTT measured by the server in data, if any.
+func serverMinRTT(data serverMeasurement, current int64) int64 {
+	var m measurement
+	if err := json.Unmarshal(data, &m); err == nil && m.TCPInfo != nil && m.TCPInfo.MinRTT > 0 &&
+		(current == 0 || m.TCPInfo.MinRTT < current) {
+		return m.TCPInfo.MinRTT
+	}
+	return current
+}
+
+// value returns the requested value or nil, if we do not have it. The min
+// RTT is the one of the round-trip test, if any, which we measure ourselves.
+func (f *printOnlyFormatter) value(rep *report) []byte {
+	switch {
+	case f.key == "download-mbit" && rep.Download != nil:
+		return []byte(fmt.Sprintf("%.1f\n", rep.Download.Throughput/1e06))
+	case f.key == "upload-mbit" && rep.Upload != nil:
+		return []byte(fmt.Sprintf("%.1f\n", rep.Upload.Throughput/1e06))
+	case f.key == "min-rtt-ms" && rep.RoundTrip != nil && rep.RoundTrip.MinSRTT > 0:
+		return []byte(fmt.Sprintf("%.1f\n", rep.RoundTrip.MinSRTT/1e03))
+	case f.key == "min-rtt-ms" && f.minRTT > 0:
+		return []byte(fmt.Sprintf("%.1f\n", float64(f.minRTT)/1e03))
+	}
+	return nil
+}
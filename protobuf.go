@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// protobufFormatter implements -format protobuf, emitting each event as an
+// Event message (see proto/ndt7.proto) preceded by its length as a varint.
+// The messages are simple enough that we encode them ourselves, rather than
+// depending on the protobuf library and on generated code.
+type protobufFormatter struct{}
+
+func (protobufFormatter) Format(name string, value interface{}, testname string) ([]byte, error) {
+	var event protoMessage
+	event.string(1, name)
+	event.string(2, testname)
+	var keys []string
+	for key := range flagTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var tag protoMessage
+		tag.string(1, key)
+		tag.string(2, flagTags[key])
+		event.bytes(3, tag)
+	}
+	event.string(4, *flagCorrelationID)
+	event.string(9, sessionID)
+	event.int64(10, iteration)
+	switch v := value.(type) {
+	case appInfo:
+		var info protoMessage
+		info.int64(1, v.NumBytes)
+		info.int64(2, v.ElapsedTime)
+		event.oneof(5, info)
+	case failureEvent:
+		var failure protoMessage
+		failure.string(1, v.Error)
+		failure.int64(2, v.ElapsedTime)
+		failure.string(3, v.Time)
+		event.oneof(7, failure)
+	case serverMeasurement:
+		event.oneof(8, v)
+	case summaryResult:
+		data, err := marshalJSON(value)
+		if err != nil {
+			return nil, err
+		}
+		result := v.result()
+		var summary protoMessage
+		summary.int64(1, result.ElapsedTime)
+		summary.int64(2, result.NumBytes)
+		summary.double(3, result.Throughput)
+		summary.bytes(4, data)
+		event.oneof(6, summary)
+	default:
+		data, err := marshalJSON(value)
+		if err != nil {
+			return nil, err
+		}
+		event.oneof(8, data)
+	}
+	var out protoMessage
+	out.uvarint(uint64(len(event)))
+	return append(out, event...), nil
+}
+
+// protoMessage is an encoded protobuf message. Like proto3 does, we omit
+// the fields with the default value.
+type protoMessage []byte
+
+// Wire types of the fields.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+func (m *protoMessage) uvarint(value uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	*m = append(*m, buffer[:binary.PutUvarint(buffer[:], value)]...)
+}
+
+func (m *protoMessage) key(field, wireType int) {
+	m.uvarint(uint64(field<<3 | wireType))
+}
+
+func (m *protoMessage) int64(field int, value int64) {
+	if value != 0 {
+		m.key(field, protoVarint)
+		m.uvarint(uint64(value))
+	}
+}
+
+func (m *protoMessage) double(field int, value float64) {
+	if value != 0 {
+		m.key(field, protoFixed64)
+		var buffer [8]byte
+		binary.LittleEndian.PutUint64(buffer[:], math.Float64bits(value))
+		*m = append(*m, buffer[:]...)
+	}
+}
+
+func (m *protoMessage) bytes(field int, value []byte) {
+	if len(value) > 0 {
+		m.oneof(field, value)
+	}
+}
+
+// oneof writes a field of a oneof, which is present even when empty.
+func (m *protoMessage) oneof(field int, value []byte) {
+	m.key(field, protoBytes)
+	m.uvarint(uint64(len(value)))
+	*m = append(*m, value...)
+}
+
+func (m *protoMessage) string(field int, value string) {
+	m.bytes(field, []byte(value))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	ndt7pb "github.com/bassosimone/ndt7-client-go-minimal/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeEvent decodes the length-delimited event in data using the code
+// generated from proto/ndt7.proto, which rejects anything not matching the
+// schema, e.g., a field whose wire type does not match its type.
+func decodeEvent(t *testing.T, data []byte) *ndt7pb.Event {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != length {
+		t.Fatalf("invalid length prefix: %d bytes after it, expected %d", len(data)-n, length)
+	}
+	event := &ndt7pb.Event{}
+	if err := proto.Unmarshal(data[n:], event); err != nil {
+		t.Fatal(err)
+	}
+	if len(event.ProtoReflect().GetUnknown()) > 0 {
+		t.Fatal("the event contains fields not in the schema")
+	}
+	return event
+}
+
+func TestProtobufDecodesWithSchema(t *testing.T) {
+	savedTags, correlationID := flagTags, *flagCorrelationID
+	savedSessionID, savedIteration := sessionID, iteration
+	defer func() {
+		flagTags, *flagCorrelationID = savedTags, correlationID
+		sessionID, iteration = savedSessionID, savedIteration
+	}()
+	flagTags = tags{"site": "lab", "isp": "example"}
+	*flagCorrelationID = "id-1"
+	sessionID, iteration = "00000000-0000-4000-8000-000000000000", 3
+	tests := []struct {
+		name   string
+		value  interface{}
+		expect *ndt7pb.Event // without the common fields
+	}{{
+		// With -clock wall, the elapsed time may be negative.
+		name:  "AppInfo",
+		value: appInfo{NumBytes: 1 << 40, ElapsedTime: -5},
+		expect: &ndt7pb.Event{Value: &ndt7pb.Event_AppInfo{
+			AppInfo: &ndt7pb.AppInfo{NumBytes: 1 << 40, ElapsedTime: -5},
+		}},
+	}, {
+		// The oneof field is present even if the message is empty.
+		name:   "AppInfo",
+		value:  appInfo{},
+		expect: &ndt7pb.Event{Value: &ndt7pb.Event_AppInfo{AppInfo: &ndt7pb.AppInfo{}}},
+	}, {
+		name:  "Failure",
+		value: failureEvent{Error: "mocked error", ElapsedTime: -1, Time: "2020-01-01T00:00:00Z"},
+		expect: &ndt7pb.Event{Value: &ndt7pb.Event_Failure{Failure: &ndt7pb.Failure{
+			Error: "mocked error", ElapsedTime: -1, Time: "2020-01-01T00:00:00Z",
+		}}},
+	}, {
+		name:  "Measurement",
+		value: serverMeasurement(`{"TCPInfo":{"MinRTT":1000}}`),
+		expect: &ndt7pb.Event{Value: &ndt7pb.Event_Json{
+			Json: []byte(`{"TCPInfo":{"MinRTT":1000}}`),
+		}},
+	}, {
+		name:   "Warning",
+		value:  "mocked warning",
+		expect: &ndt7pb.Event{Value: &ndt7pb.Event_Json{Json: []byte(`"mocked warning"`)}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := protobufFormatter{}.Format(tt.name, tt.value, "download")
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := decodeEvent(t, data)
+			expect := tt.expect
+			expect.Name, expect.Test = tt.name, "download"
+			expect.Tags = []*ndt7pb.Tag{{Key: "isp", Value: "example"}, {Key: "site", Value: "lab"}}
+			expect.CorrelationId = "id-1"
+			expect.SessionId, expect.Iteration = "00000000-0000-4000-8000-000000000000", 3
+			if !proto.Equal(event, expect) {
+				t.Fatalf("expected %v, got %v", expect, event)
+			}
+		})
+	}
+}
+
+func TestProtobufSummary(t *testing.T) {
+	summary := downloadSummary{testResult: testResult{
+		ElapsedTime: 1000000, NumBytes: 1 << 20, Throughput: 8388608,
+	}}
+	data, err := protobufFormatter{}.Format("Summary", summary, "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := decodeEvent(t, data).GetSummary()
+	if decoded == nil {
+		t.Fatal("expected a summary")
+	}
+	if decoded.ElapsedTime != 1000000 || decoded.NumBytes != 1<<20 || decoded.Throughput != 8388608 {
+		t.Fatalf("unexpected summary: %v", decoded)
+	}
+	var complete downloadSummary
+	if err := json.Unmarshal(decoded.Json, &complete); err != nil {
+		t.Fatal(err)
+	}
+	if complete.testResult != summary.testResult {
+		t.Fatalf("expected %+v, got %+v", summary.testResult, complete.testResult)
+	}
+}
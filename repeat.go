@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+)
+
+// phaseStats counts the successes and failures of a phase across the
+// iterations of -repeat.
+type phaseStats struct {
+	Successes    int64
+	Failures     int64
+	SuccessRatio float64
+}
+
+func (s *phaseStats) record(err error) {
+	if err != nil {
+		s.Failures++
+	} else {
+		s.Successes++
+	}
+	s.SuccessRatio = float64(s.Successes) / float64(s.Successes+s.Failures)
+}
+
+// subtestStats separates failing to connect from failing while running a
+// subtest, since the former means the server is not available, and both
+// from a subtest running fine but slower than expected.
+type subtestStats struct {
+	Connect       phaseStats
+	Test          phaseStats
+	LowThroughput int64 // runs below -min-download-mbit or -min-upload-mbit
+}
+
+// repeatStats aggregates the outcome of all the iterations of -repeat.
+type repeatStats struct {
+	Iterations int64
+	Locate     phaseStats
+	RoundTrip  subtestStats
+	Download   subtestStats
+	Upload     subtestStats
+}
+
+// repeatSuite runs the suite -repeat times, sleeping -repeat-interval in
+// between, and emits the aggregate stats after each iteration, so that a
+// monitoring job has the up-to-date numbers even if it is interrupted.
+func repeatSuite(ctx context.Context, useLocate bool) {
+	var stats repeatStats
+	for ; iteration < int64(*flagRepeat); iteration++ {
+		if iteration > 0 {
+			sleep(ctx, *flagRepeatInterval)
+			checkInterrupted()
+			if useLocate {
+				// The locate tokens expire, so we need fresh URLs.
+				err := locate(ctx)
+				stats.Locate.record(err)
+				if err != nil {
+					warnx(err, "locate")
+					stats.Iterations++
+					emit("RepeatStats", stats, "suite")
+					continue
+				}
+			}
+		}
+		runSuite(ctx, useLocate, &stats)
+		stats.Iterations++
+		emit("RepeatStats", stats, "suite")
+	}
+}
+
+// connectFailed reports a failure to connect, which is fatal unless we
+// are running the suite more than once.
+func connectFailed(err error, testname string) {
+	if *flagRepeat > 1 || *flagSuiteRetries > 0 {
+		suiteFailed = true
+		warnx(err, testname)
+		return
+	}
+	errx(1, err, testname)
+}
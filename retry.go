@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// suiteAttempt is the outcome of the last attempt with -suite-retries.
+type suiteAttempt struct {
+	Attempt   int // counting from one
+	Succeeded bool
+}
+
+// retrySuite runs the suite and, with -suite-retries, runs it again, after
+// -suite-retry-delay doubling at each retry and with a fresh locate, until
+// no connection or subtest fails or we exhaust the retries. Then it emits the
+// SuiteAttempt event and, if the last attempt failed, exits with the code
+// of the first failed subtest. The locateErr is the error of the initial
+// locate, if any, which counts as a failure of the first attempt. Only
+// the last attempt counts for -low-throughput-fails and -low-confidence-fails.
+func retrySuite(ctx context.Context, useLocate bool, locateErr error) {
+	delay := *flagSuiteRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := locateErr
+		if attempt > 1 {
+			sleep(ctx, delay)
+			checkInterrupted()
+			delay *= 2
+			if useLocate {
+				// The locate tokens expire, so we need fresh URLs.
+				if err = locate(ctx); err != nil {
+					warnx(err, "locate")
+				}
+			}
+		}
+		if err == nil {
+			failedExitCode, suiteFailed = 0, false
+			atomic.StoreInt32(&anyLowThroughput, 0)
+			atomic.StoreInt32(&anyLowConfidence, 0)
+			runSuite(ctx, useLocate, &repeatStats{})
+		}
+		succeeded := err == nil && !suiteFailed
+		if succeeded || attempt > *flagSuiteRetries {
+			if *flagSuiteRetries > 0 {
+				emit("SuiteAttempt", suiteAttempt{Attempt: attempt, Succeeded: succeeded}, "suite")
+			}
+			if !succeeded && *flagSuiteRetries > 0 {
+				if failedExitCode == 0 {
+					failedExitCode = 1 // e.g., locate failed
+				}
+				exit(failedExitCode)
+			}
+			return
+		}
+	}
+}
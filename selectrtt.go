@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds the time spent connecting to each candidate.
+const probeTimeout = 2 * time.Second
+
+// candidateRTT is the connect time of a locate result.
+type candidateRTT struct {
+	Server      string
+	ConnectTime int64  `json:",omitempty"` // μs
+	Error       string `json:",omitempty"`
+}
+
+// selectByRTT connects to the download host of each result concurrently
+// and returns the result with the lowest connect time, emitting the time
+// of each candidate. This is cheaper than running the round-trip subtest
+// against each candidate and good enough to avoid far away servers.
+func selectByRTT(ctx context.Context, results []locateResponseResult) (locateResponseResult, error) {
+	candidates := make([]candidateRTT, len(results))
+	var wg sync.WaitGroup
+	for idx, result := range results {
+		wg.Add(1)
+		go func(idx int, result locateResponseResult) {
+			defer wg.Done()
+			candidates[idx].Server = locateResultServer(result)
+			elapsed, err := probeConnect(ctx, result.URLs[locateDownloadURL])
+			if err != nil {
+				candidates[idx].Error = redactError(err)
+				return
+			}
+			candidates[idx].ConnectTime = int64(elapsed / time.Microsecond)
+		}(idx, result)
+	}
+	wg.Wait()
+	emit("Candidates", candidates, "locate")
+	best := -1
+	for idx, candidate := range candidates {
+		if candidate.Error == "" && (best < 0 || candidate.ConnectTime < candidates[best].ConnectTime) {
+			best = idx
+		}
+	}
+	if best < 0 {
+		return locateResponseResult{}, errors.New("cannot connect to any locate result")
+	}
+	return results[best], nil
+}
+
+// probeConnect returns how long it takes to establish a TCP connection with
+// the host of URL.
+func probeConnect(ctx context.Context, URL string) (time.Duration, error) {
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return 0, err
+	}
+	address := parsed.Host
+	if parsed.Port() == "" {
+		port := "443"
+		if parsed.Scheme == "ws" {
+			port = "80"
+		}
+		address = net.JoinHostPort(parsed.Hostname(), port)
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	start := testClock.Now()
+	conn, err := newNetDialer().DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := since(testClock, start)
+	conn.Close()
+	return elapsed, nil
+}
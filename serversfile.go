@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// readServersFile reads the servers listed in the -servers-file, one per
+// line, ignoring empty lines, comments starting with #, and duplicates.
+// Each server is either a host, e.g. ndt.example.com or [2001:db8::1]:4443,
+// or a URL, e.g. ws://ndt.example.com:8080, whose scheme and host we use.
+// We return them as locate results, such that we can test them like the
+// top locate ones.
+func readServersFile(path string) ([]locateResponseResult, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var results []locateResponseResult
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		scheme, host := "wss", line
+		if strings.Contains(line, "://") {
+			parsed, err := url.Parse(line)
+			if err != nil || parsed.Host == "" {
+				return nil, fmt.Errorf("%s:%d: invalid server URL", path, lineno)
+			}
+			scheme, host = parsed.Scheme, parsed.Host
+		}
+		if seen[scheme+"://"+host] {
+			continue // testing the same server twice would be pointless
+		}
+		seen[scheme+"://"+host] = true
+		results = append(results, locateResponseResult{
+			Machine: host,
+			URLs: map[string]string{
+				locateDownloadURL: scheme + "://" + host + "/ndt/v7/download",
+				locateUploadURL:   scheme + "://" + host + "/ndt/v7/upload",
+			},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// testServersFile runs download and upload against each server in the
+// -servers-file, testing at most -concurrency servers at a time.
+func testServersFile(ctx context.Context) error {
+	results, err := readServersFile(*flagServersFile)
+	if err != nil {
+		return err
+	}
+	testServers(ctx, results)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReadServersFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		expect  []string // download URLs, nil when we expect an error
+	}{{
+		name:    "hosts and URLs",
+		content: "ndt.example.com\nndt.example.com:4443\n[2001:db8::1]:4443\nws://ndt.example.org:8080\n",
+		expect: []string{
+			"wss://ndt.example.com/ndt/v7/download",
+			"wss://ndt.example.com:4443/ndt/v7/download",
+			"wss://[2001:db8::1]:4443/ndt/v7/download",
+			"ws://ndt.example.org:8080/ndt/v7/download",
+		},
+	}, {
+		name:    "URL with a path",
+		content: "wss://ndt.example.com/ignored?access_token=x\n",
+		expect:  []string{"wss://ndt.example.com/ndt/v7/download"},
+	}, {
+		name:    "comments and blank lines",
+		content: "# servers\n\n  ndt.example.com  \n\t\n  # disabled.example.com\n",
+		expect:  []string{"wss://ndt.example.com/ndt/v7/download"},
+	}, {
+		name:    "no trailing newline",
+		content: "ndt.example.com",
+		expect:  []string{"wss://ndt.example.com/ndt/v7/download"},
+	}, {
+		name:    "duplicates",
+		content: "ndt.example.com\nwss://ndt.example.com\nws://ndt.example.com\nndt.example.com\n",
+		expect: []string{
+			"wss://ndt.example.com/ndt/v7/download",
+			"ws://ndt.example.com/ndt/v7/download",
+		},
+	}, {
+		name:    "empty",
+		content: "# nothing to test\n",
+		expect:  []string{},
+	}, {
+		name:    "URL without host",
+		content: "ndt.example.com\nws:///ndt/v7/download\n",
+	}, {
+		name:    "unparsable URL",
+		content: "ws://ndt.example.com:port\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp, err := ioutil.TempFile("", "servers")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(fp.Name())
+			if _, err := fp.WriteString(tt.content); err != nil {
+				t.Fatal(err)
+			}
+			fp.Close()
+			results, err := readServersFile(fp.Name())
+			if tt.expect == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", results)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, result := range results {
+				got = append(got, result.URLs[locateDownloadURL])
+				if err := checkLocateResult(result); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Fatalf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestReadServersFileMissing(t *testing.T) {
+	if _, err := readServersFile("testdata/nonexistent"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
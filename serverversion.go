@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errServerTooOld indicates that the server is older than -require-server-version.
+var errServerTooOld = errors.New("server version is older than -require-server-version")
+
+// requiredServerVersion is the parsed -require-server-version, or nil.
+var requiredServerVersion []int
+
+// setRequiredServerVersion parses -require-server-version.
+func setRequiredServerVersion(version string) error {
+	if version == "" {
+		requiredServerVersion = nil
+		return nil
+	}
+	parsed, err := parseVersion(version)
+	if err != nil {
+		return fmt.Errorf("-require-server-version: %w", err)
+	}
+	requiredServerVersion = parsed
+	return nil
+}
+
+// parseVersion parses a dotted version like v0.20.6 or 0.20, ignoring any
+// pre-release or build suffix like -rc1 or +dirty.
+func parseVersion(version string) ([]int, error) {
+	version = strings.TrimPrefix(version, "v")
+	if idx := strings.IndexAny(version, "-+"); idx >= 0 {
+		version = version[:idx]
+	}
+	var parsed []int
+	for _, field := range strings.Split(version, ".") {
+		value, err := strconv.Atoi(field)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid version: %q", version)
+		}
+		parsed = append(parsed, value)
+	}
+	return parsed, nil
+}
+
+// versionLess returns whether the first version precedes the second one,
+// where missing fields count as zero, hence 1.2 is the same as 1.2.0.
+func versionLess(first, second []int) bool {
+	for idx := 0; idx < len(first) || idx < len(second); idx++ {
+		var a, b int
+		if idx < len(first) {
+			a = first[idx]
+		}
+		if idx < len(second) {
+			b = second[idx]
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+// checkServerVersion ensures, with -require-server-version, that the server
+// version in the Server header of the handshake response, which the ndt7
+// server sends as, e.g., ndt-server/v0.20.6, is not older than required.
+func checkServerVersion(header http.Header) error {
+	if requiredServerVersion == nil {
+		return nil
+	}
+	server := header.Get("Server")
+	if server == "" {
+		return errors.New("the server did not send its version in the Server header")
+	}
+	fields := strings.Fields(server) // ignore comments, if any
+	product := fields[0]
+	version, err := parseVersion(product[strings.LastIndex(product, "/")+1:])
+	if err != nil {
+		return fmt.Errorf("cannot parse the server version in %q: %w", server, err)
+	}
+	if versionLess(version, requiredServerVersion) {
+		return fmt.Errorf("%w: %q", errServerTooOld, server)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		expect  []int // nil when we expect an error
+	}{
+		{"v0.20.6", []int{0, 20, 6}},
+		{"0.20.6", []int{0, 20, 6}},
+		{"0.20", []int{0, 20}},
+		{"1", []int{1}},
+		{"v0.20.6-rc1", []int{0, 20, 6}},
+		{"v0.20.6+dirty", []int{0, 20, 6}},
+		{"v0.20.6-rc1+dirty", []int{0, 20, 6}},
+		{"v0.21.0-0.20200101000000-abcdef123456", []int{0, 21, 0}},
+		{"", nil},
+		{"v", nil},
+		{"vv1.2", nil},
+		{"-rc1", nil},
+		{"1..2", nil},
+		{"1.2.", nil},
+		{"1.x", nil},
+		{"latest", nil},
+		{" 1.2", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := parseVersion(tt.version)
+			if tt.expect == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Fatalf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		first, second []int
+		expect        bool
+	}{
+		{[]int{0, 20, 6}, []int{0, 20, 7}, true},
+		{[]int{0, 20, 7}, []int{0, 20, 6}, false},
+		{[]int{0, 20, 6}, []int{0, 20, 6}, false},
+		{[]int{0, 9}, []int{0, 10}, true}, // numeric, not lexicographic
+		{[]int{1, 2}, []int{1, 2, 0}, false},
+		{[]int{1, 2, 0}, []int{1, 2}, false},
+		{[]int{1, 2}, []int{1, 2, 1}, true},
+		{[]int{1, 2, 1}, []int{1, 2}, false},
+		{[]int{1}, []int{0, 99, 99}, false},
+		{nil, []int{0, 0, 1}, true},
+		{nil, nil, false},
+	}
+	for _, tt := range tests {
+		if got := versionLess(tt.first, tt.second); got != tt.expect {
+			t.Errorf("versionLess(%v, %v): expected %v, got %v", tt.first, tt.second, tt.expect, got)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"fmt"
+)
+
+// sessionID identifies, with -repeat, all the iterations of this run, such
+// that a store can group them, and iteration is the current iteration,
+// counting from zero. We include both in every event.
+var (
+	sessionID string
+	iteration int64
+)
+
+// newSessionID returns a random (version 4) UUID.
+func newSessionID() (string, error) {
+	var uuid [16]byte
+	if _, err := cryptorand.Read(uuid[:]); err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// setSession generates the session ID, with -repeat.
+func setSession() error {
+	if *flagRepeat <= 1 {
+		return nil
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	sessionID = id
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// smokeDuration is the download and upload runtime with -smoke.
+	smokeDuration = 2 * time.Second
+
+	// smokeRoundTripCount is the number of round-trip samples with -smoke.
+	smokeRoundTripCount = 10
+
+	// smokeMinBytes is the minimum number of bytes that the download and
+	// the upload should transfer to pass, which any working link exceeds.
+	smokeMinBytes = 1 << 16
+)
+
+// exitSmokeFailed is the exit code used when -smoke fails.
+const exitSmokeFailed = 7
+
+// smokeResult is the outcome of -smoke.
+type smokeResult struct {
+	Passed   bool
+	Failures []string `json:",omitempty"`
+}
+
+// smoke runs short round-trip, download, and upload subtests and checks
+// that all of them complete, transfer a reasonable amount of data, and that
+// the round-trip test measures the RTT. It emits a Smoke event and returns
+// an error when any check fails. Since locate does not return the round-trip
+// URL, we skip the round-trip subtest when its URL is missing.
+func smoke(ctx context.Context, useLocate bool) error {
+	if *flagDownload == "" || *flagUpload == "" {
+		return errors.New("-smoke needs the download and upload URLs")
+	}
+	*flagDuration = smokeDuration
+	if *flagRoundTripCount <= 0 {
+		*flagRoundTripCount = smokeRoundTripCount
+	}
+	var result smokeResult
+	fail := func(testname, format string, v ...interface{}) {
+		result.Failures = append(result.Failures, testname+": "+fmt.Sprintf(format, v...))
+	}
+	if *flagRoundTrip != "" {
+		emitBegin(*flagRoundTrip, roundTripRuntime, 0, roundTripMaxMessageSize, "roundtrip")
+		if conn, err := connect(ctx, flagRoundTrip, useLocate, "roundtrip"); err != nil {
+			fail("roundtrip", "%s", redactError(err))
+		} else {
+			summary, err := roundTripTest(ctx, testClock, conn)
+			closeConn(conn)
+			switch {
+			case err != nil:
+				fail("roundtrip", "%s", redactError(err))
+			case summary.SRTTStats.Count < 1 || summary.MinSRTT <= 0:
+				fail("roundtrip", "no RTT samples")
+			}
+		}
+	}
+	emitBegin(*flagDownload, *flagDuration, measureInterval, *flagMaxMessageSize, "download")
+	if conn, err := connect(ctx, flagDownload, useLocate, "download"); err != nil {
+		fail("download", "%s", redactError(err))
+	} else {
+		summary, err := downloadTest(ctx, testClock, conn)
+		closeConn(conn)
+		switch {
+		case err != nil:
+			fail("download", "%s", redactError(err))
+		case summary.NumBytes < smokeMinBytes:
+			fail("download", "only %d bytes", summary.NumBytes)
+		}
+	}
+	emitBegin(*flagUpload, *flagDuration, measureInterval, uploadMaxMessageSize(), "upload")
+	if conn, err := connect(ctx, flagUpload, useLocate, "upload"); err != nil {
+		fail("upload", "%s", redactError(err))
+	} else {
+		summary, err := uploadTest(ctx, testClock, conn)
+		closeConn(conn)
+		switch {
+		case err != nil:
+			fail("upload", "%s", redactError(err))
+		case summary.NumBytes < smokeMinBytes:
+			fail("upload", "only %d bytes", summary.NumBytes)
+		}
+	}
+	result.Passed = len(result.Failures) < 1
+	emit("Smoke", result, "suite")
+	if !result.Passed {
+		return errors.New("smoke test failed")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The servers run for maxRuntime, while -smoke stops after smokeDuration,
+// so the subtests end when the client deadline expires, which is a pass.
+func TestSmokeShortRunPasses(t *testing.T) {
+	defer saveFlags()()
+	output, restore := captureEvents()
+	defer restore()
+	srv := newFakeServer(10 * time.Second)
+	defer srv.Close()
+	*flagRoundTrip = srv.URL("roundtrip")
+	*flagDownload = srv.URL("download")
+	*flagUpload = srv.URL("upload")
+	if err := smoke(context.Background(), false); err != nil {
+		t.Fatalf("smoke failed: %s\n%s", err, output)
+	}
+}
+
+// Locate does not return the round-trip URL, hence we skip that subtest.
+func TestSmokeWithoutRoundTripPasses(t *testing.T) {
+	defer saveFlags()()
+	output, restore := captureEvents()
+	defer restore()
+	srv := newFakeServer(10 * time.Second)
+	defer srv.Close()
+	*flagRoundTrip = ""
+	*flagDownload = srv.URL("download")
+	*flagUpload = srv.URL("upload")
+	if err := smoke(context.Background(), false); err != nil {
+		t.Fatalf("smoke failed: %s\n%s", err, output)
+	}
+	for _, event := range decodeEvents(t, output) {
+		if string(event["Test"]) == `"roundtrip"` {
+			t.Fatalf("unexpected round-trip event: %v", event)
+		}
+	}
+}
+
+func TestDownloadShorterThanServerPasses(t *testing.T) {
+	defer saveFlags()()
+	_, restore := captureEvents()
+	defer restore()
+	srv := newFakeServer(10 * time.Second)
+	defer srv.Close()
+	*flagDownload = srv.URL("download")
+	*flagDuration = 500 * time.Millisecond
+	conn, err := dialer(context.Background(), *flagDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeConn(conn)
+	summary, err := downloadTest(context.Background(), realClock{}, conn)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if summary.NumBytes < smokeMinBytes {
+		t.Fatalf("only %d bytes", summary.NumBytes)
+	}
+	if elapsed := time.Duration(summary.ElapsedTime) * time.Microsecond; elapsed < *flagDuration {
+		t.Fatalf("download ended after %s", elapsed)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "errors"
+
+// setSocketBuffers fails with -so-rcvbuf or -so-sndbuf, since we only
+// support Linux and BSD systems.
+func setSocketBuffers(rcvbuf, sndbuf int) error {
+	if rcvbuf > 0 || sndbuf > 0 {
+		return errors.New("-so-rcvbuf and -so-sndbuf are only supported on Linux and BSD")
+	}
+	return nil
+}
+
+func socketBuffersApplied() socketBuffers {
+	return appliedBuffers
+}
@@ -0,0 +1,53 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// setSocketBuffers arranges, with -so-rcvbuf and -so-sndbuf, for setting the
+// receive and send buffer sizes of the sockets before connecting, which
+// allows to negotiate a suitable window scale on high-BDP paths.
+func setSocketBuffers(rcvbuf, sndbuf int) error {
+	if rcvbuf > 0 {
+		socketOptions = append(socketOptions, func(fd uintptr) error {
+			return setSocketBuffer(fd, syscall.SO_RCVBUF, rcvbuf, &appliedBuffers.RcvBuf)
+		})
+	}
+	if sndbuf > 0 {
+		socketOptions = append(socketOptions, func(fd uintptr) error {
+			return setSocketBuffer(fd, syscall.SO_SNDBUF, sndbuf, &appliedBuffers.SndBuf)
+		})
+	}
+	return nil
+}
+
+// setSocketBuffer sets the given buffer option and saves the size actually
+// applied, since the kernel may clamp it and Linux doubles it.
+func setSocketBuffer(fd uintptr, option, size int, applied *int) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, option, size); err != nil {
+		return err
+	}
+	value, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, option)
+	if err != nil {
+		return err
+	}
+	appliedBuffersMu.Lock()
+	*applied = value
+	appliedBuffersMu.Unlock()
+	return nil
+}
+
+// appliedBuffersMu protects appliedBuffers, since we may dial concurrently.
+var appliedBuffersMu sync.Mutex
+
+// socketBuffersApplied returns the buffer sizes applied by the kernel. They
+// do not depend on the connection, since we always request the same sizes.
+func socketBuffersApplied() socketBuffers {
+	appliedBuffersMu.Lock()
+	defer appliedBuffersMu.Unlock()
+	return appliedBuffers
+}
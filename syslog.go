@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// setSyslog routes, with -syslog, the events to syslog rather than to the
+// standard output. The address is empty for the local syslog or a URL like
+// udp://logs.example.com:514 for a remote one. The events are still JSON
+// (or InfluxDB lines), such that log parsers get all the fields. Since all
+// the events go to syslog, we reject the flags choosing other outputs.
+func setSyslog(enabled bool, address string) error {
+	if !enabled {
+		return nil
+	}
+	if *flagPrintOnly != "" || *flagSamplesOut != "" || *flagSummaryOut != "" {
+		return errors.New("-syslog conflicts with -print-only, -samples-out, and -summary-out")
+	}
+	var network, raddr string
+	if address != "" {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return err
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("-syslog-addr must be like udp://host:514")
+		}
+		network, raddr = parsed.Scheme, parsed.Host
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "ndt7-client")
+	if err != nil {
+		return err
+	}
+	syslogEvent = func(name string, data []byte) {
+		message := string(bytes.TrimSpace(data))
+		if problemEvents[name] {
+			writer.Warning(message)
+			return
+		}
+		writer.Info(message)
+	}
+	return nil
+}
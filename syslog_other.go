@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+// setSyslog fails with -syslog, since log/syslog is not available.
+func setSyslog(enabled bool, address string) error {
+	if enabled {
+		return errors.New("-syslog is not supported on this system")
+	}
+	return nil
+}
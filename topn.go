@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// serverResult contains the results of testing a single server.
+type serverResult struct {
+	Server        string
+	Download      *downloadSummary `json:",omitempty"`
+	DownloadError string           `json:",omitempty"`
+	Upload        *uploadSummary   `json:",omitempty"`
+	UploadError   string           `json:",omitempty"`
+}
+
+// testTopN runs download and upload against the -test-top-n nearest servers
+// returned by locate.
+func testTopN(ctx context.Context) error {
+	results, err := locateResults(ctx)
+	if err != nil {
+		return err
+	}
+	if len(results) > *flagTestTopN {
+		results = results[:*flagTestTopN]
+	}
+	testServers(ctx, results)
+	return nil
+}
+
+// checkConcurrency rejects -concurrency greater than one with the formatters
+// that remember the server or the min RTT of the current subtest, since the
+// subtests of servers tested concurrently would overwrite each other's.
+func checkConcurrency() error {
+	if *flagConcurrency <= 1 {
+		return nil
+	}
+	switch defaultFormatter.(type) {
+	case *influxFormatter, *loglineFormatter, *printOnlyFormatter:
+		return errors.New("-concurrency greater than one requires -format json or protobuf")
+	}
+	return nil
+}
+
+// testServers runs download and upload against the server of each result,
+// testing at most -concurrency servers at a time, and emits the results of
+// all servers once done.
+func testServers(ctx context.Context, results []locateResponseResult) {
+	concurrency := *flagConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	serverResults := make([]serverResult, len(results))
+	var wg sync.WaitGroup
+	for idx, result := range results {
+		wg.Add(1)
+		go func(idx int, result locateResponseResult) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			serverResults[idx] = testServer(ctx, result)
+		}(idx, result)
+	}
+	wg.Wait()
+	emit("ServerResults", serverResults, "suite")
+}
+
+// testServer runs download and upload against the server of result. Like
+// the suite, it connects using connect, hence it honours -trace and
+// -max-connect-attempts and it emits the Connect events, but it does not
+// run locate again, since we want to test this specific server.
+func testServer(ctx context.Context, result locateResponseResult) serverResult {
+	downloadURL := result.URLs[locateDownloadURL]
+	uploadURL := result.URLs[locateUploadURL]
+	sr := serverResult{Server: locateResultServer(result)}
+	if err := checkLocateResult(result); err != nil {
+		warnx(err, "locate")
+		sr.DownloadError, sr.UploadError = err.Error(), err.Error()
+		return sr
+	}
+	emitBegin(downloadURL, *flagDuration, measureInterval, *flagMaxMessageSize, "download")
+	if conn, err := connect(ctx, &downloadURL, false, "download"); err != nil {
+		if !ndt5Fallback(ctx, err, downloadURL, "download") {
+			warnx(err, "download")
+			sr.DownloadError = redactError(err)
+		}
+	} else {
+		summary, err := downloadTest(ctx, testClock, conn)
+		closeConn(conn)
+		sr.Download = &summary
+		belowMinThroughput(summary.testResult, *flagMinDownloadMbit, "download")
+		if err != nil && !ndt5Fallback(ctx, err, downloadURL, "download") {
+			warnx(err, "download")
+			sr.DownloadError = redactError(err)
+		}
+	}
+	emitBegin(uploadURL, *flagDuration, measureInterval, uploadMaxMessageSize(), "upload")
+	if conn, err := connect(ctx, &uploadURL, false, "upload"); err != nil {
+		if !ndt5Fallback(ctx, err, uploadURL, "upload") {
+			warnx(err, "upload")
+			sr.UploadError = redactError(err)
+		}
+	} else {
+		summary, err := uploadTest(ctx, testClock, conn)
+		closeConn(conn)
+		sr.Upload = &summary
+		belowMinThroughput(summary.testResult, *flagMinUploadMbit, "upload")
+		if err != nil && !ndt5Fallback(ctx, err, uploadURL, "upload") {
+			warnx(err, "upload")
+			sr.UploadError = redactError(err)
+		}
+	}
+	return sr
+}
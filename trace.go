@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// traceEvent is a step of establishing the websocket connection.
+type traceEvent struct {
+	Event       string
+	ElapsedTime int64  // since we started dialing (ns)
+	Addr        string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// withTrace returns a context that, when passed to the websocket dialer,
+// emits a Trace event for each step of the connection and handshake.
+func withTrace(ctx context.Context, testname string) context.Context {
+	start := testClock.Now()
+	emitTrace := func(event, addr string, err error) {
+		ev := traceEvent{
+			Event:       event,
+			ElapsedTime: int64(since(testClock, start)),
+			Addr:        addr,
+		}
+		if err != nil {
+			ev.Error = redactError(err)
+		}
+		emit("Trace", ev, testname)
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			emitTrace("DNSStart", info.Host, nil)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			var addrs string
+			for _, addr := range info.Addrs {
+				if addrs != "" {
+					addrs += ","
+				}
+				addrs += addr.String()
+			}
+			emitTrace("DNSDone", addrs, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			emitTrace("ConnectStart", addr, nil)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			emitTrace("ConnectDone", addr, err)
+		},
+		TLSHandshakeStart: func() {
+			emitTrace("TLSHandshakeStart", "", nil)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			emitTrace("TLSHandshakeDone", "", err)
+		},
+		WroteHeaders: func() {
+			emitTrace("WroteHeaders", "", nil)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			emitTrace("WroteRequest", "", info.Err)
+		},
+		GotFirstResponseByte: func() {
+			emitTrace("GotFirstResponseByte", "", nil)
+		},
+	})
+}
+
+// readEvent is the result of a single read of the download.
+type readEvent struct {
+	NumBytes    int
+	ElapsedTime int64 // since the download began (μs)
+}
+
+// readTracer wraps a reader of the download to emit a Read event for each
+// read, up to -trace-reads-max reads, since that is a lot of events.
+type readTracer struct {
+	io.Reader
+	clk   clock
+	start time.Time
+	count *int64
+}
+
+func (r readTracer) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	if n > 0 {
+		*r.count++
+		if *r.count == *flagTraceReadsMax+1 {
+			emit("Warning", "reached -trace-reads-max, not tracing more reads", "download")
+		}
+		if *r.count <= *flagTraceReadsMax {
+			emit("Read", readEvent{
+				NumBytes:    n,
+				ElapsedTime: int64(since(r.clk, r.start) / time.Microsecond),
+			}, "download")
+		}
+	}
+	return n, err
+}
+
+// countingReader wraps a reader of the download to atomically add the bytes
+// of each read to count, such that we can sample it in the background.
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (r countingReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// byteSample is the number of bytes downloaded at a given time.
+type byteSample struct {
+	NumBytes    int64
+	ElapsedTime int64 // since the download began (μs)
+}
+
+// startByteSampler starts emitting, every -sample-interval, a Bytes event
+// with the value of count, which the download updates for each read, such
+// that the samples do not depend on when messages arrive. It returns the
+// function to stop sampling, which waits for the sampler to finish.
+func startByteSampler(clk clock, start time.Time, count *int64) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := clk.NewTicker(*flagSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				emit("Bytes", byteSample{
+					NumBytes:    atomic.LoadInt64(count),
+					ElapsedTime: int64(since(clk, start) / time.Microsecond),
+				}, "download")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// slowReader wraps a reader of the download to sleep after each read, which
+// simulates a slow reader, exercising the flow control of the server.
+type slowReader struct {
+	io.Reader
+	clk   clock
+	delay time.Duration
+}
+
+func (r slowReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	r.clk.Sleep(r.delay)
+	return n, err
+}
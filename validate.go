@@ -0,0 +1,40 @@
+//go:build ndt7validate
+// +build ndt7validate
+
+package main
+
+// This file is only compiled with `go build -tags ndt7validate` and checks
+// that every event we emit is valid JSON, to catch emitting malformed JSON
+// as soon as we introduce it. It is meant for development only.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+func init() {
+	validateEvent = func(name string, value interface{}, data []byte) {
+		if _, ok := value.(serverMeasurement); ok {
+			return // we pass it through as sent by the server
+		}
+		switch defaultFormatter.(type) {
+		case jsonFormatter, *groupedFormatter:
+		default:
+			return
+		}
+		// With -grouped, the data may start with the header of the test.
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var event map[string]interface{}
+			err := decoder.Decode(&event)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				panic(fmt.Sprintf("ndt7validate: %s event is not valid JSON: %s: %q", name, err, data))
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+//go:build ndt7validate
+// +build ndt7validate
+
+package main
+
+// Run these tests with `go test -tags ndt7validate`.
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// validateEvents returns one value for each type of event that we emit.
+func validateEvents() []struct {
+	name, testname string
+	value          interface{}
+} {
+	download := downloadSummary{
+		testResult: newTestResult(time.Second, 1<<20),
+		FrameSizes: newFrameSizeHistogram(),
+	}
+	upload := uploadSummary{testResult: newTestResult(time.Second, 1<<20)}
+	roundTrip := roundTripSummary{SRTTStats: newRTTStats([]float64{1000, 2000})}
+	closeErr := &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "bye \"now\""}
+	return []struct {
+		name, testname string
+		value          interface{}
+	}{
+		{"Begin", "download", beginEvent{URL: "wss://example.com/ndt/v7/download?access_token=x"}},
+		{"Connect", "download", connectEvent{LocalAddr: "[::1]:1234", RemoteAddr: "[::1]:443"}},
+		{"Trace", "download", traceEvent{Event: "DNSStart", Addr: "example.com"}},
+		{"AppInfo", "download", appInfo{NumBytes: 1, ElapsedTime: 2, Progress: 3}},
+		{"AppInfo", "roundtrip", roundTripAppInfo{SRTT: 1, RTTVar: 2, Warmup: true}},
+		{"RTTStats", "roundtrip", newRTTStats([]float64{1, 2, 3})},
+		{"Measurement", "download", serverMeasurement(`{"TCPInfo":{"MinRTT":1000}}`)},
+		{"Read", "download", readEvent{NumBytes: 1, ElapsedTime: 2}},
+		{"Bytes", "download", byteSample{NumBytes: 1, ElapsedTime: 2}},
+		{"Summary", "download", download},
+		{"Summary", "upload", upload},
+		{"Summary", "roundtrip", roundTrip},
+		{"Report", "suite", report{Download: &download, Upload: &upload, RoundTrip: &roundTrip}},
+		{"Warning", "main", "a \"quoted\" warning\n"},
+		{"Abort", "roundtrip", "min RTT exceeds -max-rtt"},
+		{"Failure", "download", newFailureEvent(errors.New("mocked error"))},
+		{"Failure", "upload", newFailureEvent(&subtestError{err: closeErr, elapsed: time.Second})},
+		{"Failure", "download", newFailureEvent(fmt.Errorf("wrapped: %w", closeErr))},
+		{"Burst", "upload", burstEvent{Burst: 1, Runtime: 2}},
+		{"ColdWarm", "download", coldWarmResult{Cold: &download, Warm: &download, WarmToCold: 1}},
+		{"LatencyUnderLoad", "roundtrip", latencyUnderLoadResult{}},
+		{"Candidates", "locate", []candidateRTT{{Server: "a"}, {Server: "b", Error: "timeout"}}},
+		{"LocateResponse", "locate", `{"results":[]}`},
+		{"Server", "locate", "mlab1-abc0t.mlab-oti.measurement-lab.org"},
+		{"ServerResults", "suite", []serverResult{{Server: "a", Download: &download}}},
+		{"RepeatStats", "suite", repeatStats{Iterations: 1}},
+		{"SuiteAttempt", "suite", suiteAttempt{Attempt: 1, Succeeded: true}},
+		{"Smoke", "suite", smokeResult{Failures: []string{"download: only 0 bytes"}}},
+		{"Protocol", "download", "ndt5"},
+	}
+}
+
+func TestValidateAllEvents(t *testing.T) {
+	formatter, tagsCopy, correlationID := defaultFormatter, flagTags, *flagCorrelationID
+	savedSessionID := sessionID
+	defer func() {
+		defaultFormatter, flagTags, *flagCorrelationID = formatter, tagsCopy, correlationID
+		sessionID = savedSessionID
+	}()
+	_, restore := captureEvents()
+	defer restore()
+	configs := []struct {
+		name    string
+		grouped bool
+		setup   func()
+	}{
+		{"plain", false, func() {}},
+		{"grouped", true, func() {}},
+		{"tags", false, func() {
+			flagTags = tags{"isp": "a \"quoted\" isp", "site": "x=y"}
+		}},
+		{"correlation ID and session", true, func() {
+			*flagCorrelationID = "id-\"1\""
+			sessionID = "00000000-0000-4000-8000-000000000000"
+		}},
+	}
+	for _, config := range configs {
+		t.Run(config.name, func(t *testing.T) {
+			if err := setFormatter("json", config.grouped); err != nil {
+				t.Fatal(err)
+			}
+			flagTags, *flagCorrelationID, sessionID = make(tags), "", ""
+			config.setup()
+			for _, ev := range validateEvents() {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%s %s: %v", ev.testname, ev.name, r)
+						}
+					}()
+					emit(ev.name, ev.value, ev.testname)
+				}()
+			}
+		})
+	}
+}
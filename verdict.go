@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lastReport is the report of the last run of the suite, if any.
+var lastReport *report
+
+// printVerdict prints on the standard error, when it is a terminal, a line
+// for humans like "Done: download 94.2 Mbit/s, upload 11.3 Mbit/s, 0 errors".
+// We only do that when running interactively, since the standard output
+// is meant for machines and cron jobs would email us the standard error.
+// Likewise, -quiet-on-success means that a successful run says nothing.
+func printVerdict() {
+	if lastReport == nil || !isTerminal(os.Stderr) || *flagQuietOnSuccess {
+		return
+	}
+	var fields []string
+	if lastReport.Download != nil {
+		fields = append(fields, fmt.Sprintf("download %.1f Mbit/s", lastReport.Download.Throughput/1e06))
+	}
+	if lastReport.Upload != nil {
+		fields = append(fields, fmt.Sprintf("upload %.1f Mbit/s", lastReport.Upload.Throughput/1e06))
+	}
+	if lastReport.RoundTrip != nil {
+		fields = append(fields, fmt.Sprintf("min RTT %.1f ms", lastReport.RoundTrip.MinSRTT/1e03))
+	}
+	noun := "errors"
+	if failureCount == 1 {
+		noun = "error"
+	}
+	fields = append(fields, fmt.Sprintf("%d %s", failureCount, noun))
+	fmt.Fprintf(os.Stderr, "Done: %s\n", strings.Join(fields, ", "))
+}
+
+// isTerminal returns whether fp is a terminal, or at least a character
+// device, which is good enough to tell apart pipes and files.
+func isTerminal(fp *os.File) bool {
+	info, err := fp.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// pendingReport is the report of the running suite, which we still need
+// to POST to -webhook, or nil.
+var pendingReport *report
+
+// postReport POSTs the pending report, if any, to -webhook. A failure is
+// only reported, so that it does not change the exit code.
+func postReport() {
+	rep := pendingReport
+	pendingReport = nil
+	if rep == nil || *flagWebhook == "" {
+		return
+	}
+	if rep.EndTime == "" {
+		// We are exiting early because of a failure.
+		rep.Server = reportServer()
+		rep.Location = serverLocation
+		rep.EndTime = time.Now().Format(time.RFC3339Nano)
+	}
+	data, err := marshalJSON(rep)
+	if err != nil {
+		warnx(err, "webhook")
+		return
+	}
+	req, err := http.NewRequest("POST", *flagWebhook, bytes.NewReader(data))
+	if err != nil {
+		warnx(err, "webhook")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *flagWebhookAuth != "" {
+		req.Header.Set("Authorization", *flagWebhookAuth)
+	}
+	client := &http.Client{Timeout: *flagWebhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		warnx(err, "webhook")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		warnx(fmt.Errorf("webhook: unexpected status: %s", resp.Status), "webhook")
+	}
+}
+
+// exit writes the last line of the formatter, if any, posts the pending
+// report, if any, flushes the output, and exits with exitcode.
+func exit(exitcode int) {
+	emitFinal(exitcode)
+	postReport()
+	flushOutputs()
+	os.Exit(exitcode)
+}